@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	myfuse "github.com/jvns/git-commit-folders/fuse"
+	"github.com/jvns/git-commit-folders/fuse2nfs"
+)
+
+/*
+  The subcommands. Every command has its own flags and help
+  (`git-commit-folders help mount` or `git-commit-folders mount -h`), and they
+  all use the same exit codes:
+
+  0  it worked
+  1  something went wrong
+  2  you ran it wrong (a bad flag, a missing argument, an unknown -type)
+*/
+
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	help    string
+	run     func(c *command, args []string) int
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{
+			name:    "mount",
+			args:    "[flags] <mountpoint>",
+			summary: "mount the folders",
+			help: "Mounts a folder for every commit at <mountpoint>, and unmounts it when you\n" +
+				"press Ctrl+C (or when you run `unmount`, with -daemon).",
+			run: mountCommand,
+		},
+		{
+			name:    "unmount",
+			args:    "<mountpoint>",
+			summary: "stop a mount, even if its server is gone",
+			help: "Asks the server for <mountpoint> to unmount and exit. If it's gone or doesn't\n" +
+				"exit, unmounts it anyway (lazily if something is still using it).",
+			run: unmountCommand,
+		},
+		{
+			name:    "list",
+			args:    "[mountpoint]",
+			summary: "show what's mounted",
+			help: "Shows every mount and whether its server is still running. With a\n" +
+				"<mountpoint>, exits with 1 unless that one is mounted and running.",
+			run: listCommand,
+		},
+		{
+			name:    "serve",
+			args:    "[flags]",
+			summary: "serve the folders without mounting them (http, sftp, ...)",
+			help:    "Serves the folders over the network, for browsers, scripts and other computers.",
+			run:     serveCommand,
+		},
+		{
+			name:    "export",
+			args:    "[flags] <path> <dest>",
+			summary: "copy a file or folder out without mounting",
+			help: "Copies <path> (like archives/main.tar.gz or oci/v1.2.3) to <dest>, or to\n" +
+				"stdout if <dest> is -.",
+			run: exportCommand,
+		},
+		{
+			name:    "doctor",
+			args:    "[flags]",
+			summary: "check which kinds of mounts will work here",
+			help: "Checks the repository, which mount types this computer supports, and\n" +
+				"whether any mounts have been left behind by a server that's gone.",
+			run: doctorCommand,
+		},
+	}
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	/* the old name */
+	if name == "status" {
+		return findCommand("list")
+	}
+	return nil
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		usage()
+		return exitUsage
+	}
+	switch args[0] {
+	case "-h", "-help", "--help":
+		usage()
+		return exitOK
+	case "help":
+		if len(args) > 1 {
+			if c := findCommand(args[1]); c != nil {
+				c.flags(nil).Usage()
+				return exitOK
+			}
+		}
+		usage()
+		return exitOK
+	}
+	if strings.HasPrefix(args[0], "-") {
+		return legacyCommand(args)
+	}
+	c := findCommand(args[0])
+	if c == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		usage()
+		return exitUsage
+	}
+	return c.run(c, args[1:])
+}
+
+func usage() {
+	prog := filepath.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", prog)
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun `%s help <command>` for a command's flags.\n", prog)
+}
+
+/* a FlagSet whose -h prints the command's help. opts can be nil for help */
+func (c *command) flags(opts *options) *flag.FlagSet {
+	fl := flag.NewFlagSet(c.name, flag.ContinueOnError)
+	if opts == nil {
+		opts = &options{}
+	}
+	switch c.name {
+	case "mount":
+		repoFlags(fl, opts)
+		mountFlags(fl, opts)
+	case "serve":
+		repoFlags(fl, opts)
+		serveFlags(fl, opts)
+	case "export", "doctor":
+		repoFlags(fl, opts)
+	}
+	fl.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n\n%s\n", filepath.Base(os.Args[0]), c.name, c.args, c.help)
+		if hasFlags(fl) {
+			fmt.Fprintf(os.Stderr, "\nFlags:\n")
+			fl.PrintDefaults()
+		}
+	}
+	return fl
+}
+
+func hasFlags(fl *flag.FlagSet) bool {
+	found := false
+	fl.VisitAll(func(*flag.Flag) { found = true })
+	return found
+}
+
+/*
+parses flags and returns the other arguments, so that flags can go before or
+after them (`mount /tmp/mnt -type nfs` works too)
+*/
+func parseArgs(fl *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fl.Parse(args); err != nil {
+			return nil, err
+		}
+		if fl.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fl.Arg(0))
+		args = fl.Args()[1:]
+	}
+}
+
+/* parses args, and if that doesn't work says what exit code to use */
+func (c *command) parse(opts *options, args []string, nargs ...int) ([]string, int, bool) {
+	fl := c.flags(opts)
+	positional, err := parseArgs(fl, args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil, exitOK, false
+	} else if err != nil {
+		return nil, exitUsage, false
+	}
+	for _, n := range nargs {
+		if len(positional) == n {
+			return positional, exitOK, true
+		}
+	}
+	fl.Usage()
+	return nil, exitUsage, false
+}
+
+func usageError(c *command, format string, args ...interface{}) int {
+	fmt.Fprintf(os.Stderr, format+"\n\n", args...)
+	c.flags(nil).Usage()
+	return exitUsage
+}
+
+func typeNames(types map[string]func(*myfuse.FS, options) error) string {
+	var names []string
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+func repoFlags(fl *flag.FlagSet, opts *options) {
+	fl.StringVar(&opts.repoDir, "repo", ".", "the git repository")
+}
+
+func mountFlags(fl *flag.FlagSet, opts *options) {
+	fl.StringVar(&opts.typ, "type", "fuse", "how to mount it: "+typeNames(mountTypes))
+	fl.BoolVar(&opts.writableRefs, "writable-refs", false, "allow creating, moving and deleting branches and tags with ln -s and rm")
+	fl.BoolVar(&opts.forceTags, "force-tags", false, "with -writable-refs, allow replacing and deleting existing tags")
+	fl.BoolVar(&opts.workspaces, "workspaces", false, "add a workspaces/ folder where you can edit files and make commits")
+	fl.BoolVar(&opts.hardlinks, "hardlink-blobs", false, "make identical files in commits/ look like hardlinks, so that du counts them once")
+	fl.BoolVar(&opts.follow, "follow-symlinks", false, "with -type nfs, show what symlinks point to instead of symlinks (webdav always does this)")
+	fl.BoolVar(&opts.daemon, "daemon", false, "run in the background (see the list and unmount commands)")
+}
+
+func serveFlags(fl *flag.FlagSet, opts *options) {
+	fl.StringVar(&opts.typ, "type", "http", "what to serve: "+typeNames(serveTypes))
+	fl.StringVar(&opts.addr, "addr", "", "the address to listen on (default 127.0.0.1:8080, or 127.0.0.1:2222 for sftp)")
+	home, _ := os.UserHomeDir()
+	fl.StringVar(&opts.hostKey, "host-key", filepath.Join(home, ".ssh", "git-commit-folders_host_key"), "with -type sftp, the SSH host key (it gets made if it doesn't exist)")
+	fl.StringVar(&opts.authKeys, "authorized-keys", filepath.Join(home, ".ssh", "authorized_keys"), "with -type sftp, the public keys that are allowed to log in")
+}
+
+func defaultAddr(opts *options) {
+	if opts.addr == "" && opts.typ == "sftp" {
+		opts.addr = "127.0.0.1:2222"
+	} else if opts.addr == "" {
+		opts.addr = "127.0.0.1:8080"
+	}
+}
+
+/* git-commit-folders mount [flags] <mountpoint> */
+func mountCommand(c *command, args []string) int {
+	var opts options
+	positional, code, ok := c.parse(&opts, args, 1)
+	if !ok {
+		return code
+	}
+	opts.mountpoint = positional[0]
+	if mountTypes[opts.typ] == nil {
+		return usageError(c, "Can't mount with -type %s", opts.typ)
+	}
+	return runMount(opts)
+}
+
+/* git-commit-folders serve [flags] */
+func serveCommand(c *command, args []string) int {
+	var opts options
+	_, code, ok := c.parse(&opts, args, 0)
+	if !ok {
+		return code
+	}
+	if serveTypes[opts.typ] == nil {
+		return usageError(c, "Can't serve -type %s", opts.typ)
+	}
+	defaultAddr(&opts)
+	return runServe(opts)
+}
+
+/* git-commit-folders export [flags] <path> <dest> */
+func exportCommand(c *command, args []string) int {
+	var opts options
+	positional, code, ok := c.parse(&opts, args, 2)
+	if !ok {
+		return code
+	}
+	fs, err := openFS(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	src, dest := positional[0], positional[1]
+	exporter := fuse2nfs.Fuse2Dir(fs)
+	if dest == "-" {
+		err = exporter.WriteFile(src, os.Stdout)
+	} else {
+		err = exporter.Copy(src, dest)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitOK
+}
+
+/*
+the old way, before there were commands: `-type nfs -mountpoint /tmp/mnt`
+mounts, and the types that don't mount serve
+*/
+func legacyCommand(args []string) int {
+	var opts options
+	fl := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	repoFlags(fl, &opts)
+	mountFlags(fl, &opts)
+	home, _ := os.UserHomeDir()
+	fl.StringVar(&opts.addr, "addr", "", "the address to listen on")
+	fl.StringVar(&opts.hostKey, "host-key", filepath.Join(home, ".ssh", "git-commit-folders_host_key"), "with -type sftp, the SSH host key")
+	fl.StringVar(&opts.authKeys, "authorized-keys", filepath.Join(home, ".ssh", "authorized_keys"), "with -type sftp, the public keys that are allowed to log in")
+	fl.StringVar(&opts.mountpoint, "mountpoint", "", "mountpoint")
+	fl.Usage = usage
+	if err := fl.Parse(args); errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	} else if err != nil {
+		return exitUsage
+	}
+	fmt.Fprintf(os.Stderr, "(this still works, but it's `%s mount` or `%s serve` now)\n", fl.Name(), fl.Name())
+	if opts.mountpoint != "" && mountTypes[opts.typ] != nil {
+		return runMount(opts)
+	} else if opts.mountpoint == "" && serveTypes[opts.typ] != nil {
+		defaultAddr(&opts)
+		return runServe(opts)
+	}
+	fmt.Fprintf(os.Stderr, "Can't use -type %s like that\n\n", opts.typ)
+	usage()
+	return exitUsage
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/*
+  Running in the background, and keeping track of what's mounted.
+
+  `-daemon` starts the same command again in the background (Go can't fork)
+  as a "supervisor", which starts it a third time as the real server and
+  waits for it. If the server exits for any reason, even a crash or kill -9,
+  the supervisor unmounts whatever it left behind. The command you ran waits
+  until the server says the mount is really there (over a pipe on fd 3) and
+  then exits.
+
+  Every mount (in the background or not) has a state file, which is how the
+  `list` and `unmount` commands find it.
+*/
+
+const roleEnv = "GIT_COMMIT_FOLDERS_ROLE"
+const logEnv = "GIT_COMMIT_FOLDERS_LOG"
+
+type mountState struct {
+	Pid        int       `json:"pid"`
+	Mountpoint string    `json:"mountpoint"`
+	Args       []string  `json:"args"`
+	Log        string    `json:"log,omitempty"`
+	Started    time.Time `json:"started"`
+}
+
+func stateDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "git-commit-folders")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("git-commit-folders-%d", os.Getuid()))
+}
+
+/* /home/me/mnt -> <stateDir>/_home_me_mnt.json */
+func statePath(mountpoint, ext string) string {
+	return filepath.Join(stateDir(), strings.ReplaceAll(absPath(mountpoint), "/", "_")+ext)
+}
+
+/*
+the path `mount` would show, which has no symlinks in it (on a Mac, /tmp is
+really /private/tmp). We only resolve the parent: if the mountpoint itself is
+a mount whose server went away, looking at it can fail or hang.
+*/
+func absPath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return filepath.Clean(p)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(abs))
+	if err != nil {
+		return abs
+	}
+	return filepath.Join(dir, filepath.Base(abs))
+}
+
+func writeState(mountpoint string) error {
+	if err := os.MkdirAll(stateDir(), 0o700); err != nil {
+		return err
+	}
+	st := mountState{
+		Pid:        os.Getpid(),
+		Mountpoint: absPath(mountpoint),
+		Args:       os.Args,
+		Log:        os.Getenv(logEnv),
+		Started:    time.Now(),
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(mountpoint, ".json"), data, 0o600)
+}
+
+func readState(path string) (*mountState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var st mountState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &st, nil
+}
+
+func removeState(mountpoint string) {
+	os.Remove(statePath(mountpoint, ".json"))
+}
+
+func processRunning(pid int) bool {
+	return pid > 0 && syscall.Kill(pid, 0) == nil
+}
+
+/*
+Whether something is mounted there, according to `mount`. We don't stat the
+mountpoint, because that hangs forever if it's an NFS mount whose server
+is gone.
+*/
+func isMounted(mountpoint string) bool {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return false
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), " on "+absPath(mountpoint)+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+/* wait until the mount really shows up instead of guessing how long it takes */
+func waitForMount(mountpoint string, serverDone <-chan error) error {
+	deadline := time.Now().Add(10 * time.Second)
+	for !isMounted(mountpoint) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s still isn't mounted after 10 seconds", mountpoint)
+		}
+		select {
+		case err := <-serverDone:
+			if err == nil {
+				err = errors.New("the server stopped")
+			}
+			return err
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+/*
+Unmount, and if that doesn't work (usually because something is still
+using it), do a lazy unmount so that it goes away as soon as it's not busy
+anymore. That's what we want when the server is gone: a dead mount just
+makes everything that touches it hang or fail.
+*/
+func unmount(mountpoint string) error {
+	var attempts [][]string
+	switch runtime.GOOS {
+	case "linux":
+		attempts = [][]string{
+			{"umount", mountpoint},
+			{"fusermount", "-u", mountpoint},
+			{"umount", "-l", mountpoint},
+			{"fusermount", "-u", "-z", mountpoint},
+		}
+	default:
+		attempts = [][]string{
+			{"umount", mountpoint},
+			{"umount", "-f", mountpoint},
+			{"diskutil", "unmount", "force", mountpoint},
+		}
+	}
+	var errs []string
+	for _, args := range attempts {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", strings.Join(args, " "), strings.TrimSpace(string(out))))
+		if !isMounted(mountpoint) {
+			return nil
+		}
+	}
+	return fmt.Errorf("couldn't unmount %s:\n%s", mountpoint, strings.Join(errs, "\n"))
+}
+
+var readyOnce sync.Once
+
+/*
+tell whoever ran `-daemon` that we're mounted (err == nil) or that we failed.
+Only the first call counts, after that fd 3 is closed (or is something else)
+*/
+func notifyReady(err error) {
+	if os.Getenv(roleEnv) != "server" {
+		return
+	}
+	readyOnce.Do(func() {
+		if ready := os.NewFile(3, "ready"); ready != nil {
+			sendReady(ready, err)
+		}
+	})
+}
+
+func sendReady(ready *os.File, err error) {
+	if err != nil {
+		fmt.Fprintf(ready, "error: %s\n", err)
+	} else {
+		fmt.Fprintln(ready, "ready")
+	}
+	ready.Close()
+}
+
+/* the same command, with a different role */
+func reexec(role string, stdout *os.File, ready *os.File) *exec.Cmd {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), roleEnv+"="+role)
+	cmd.Stdout = stdout
+	cmd.Stderr = stdout
+	cmd.ExtraFiles = []*os.File{ready}
+	return cmd
+}
+
+/* what you ran: start the supervisor and wait until the mount is ready */
+func startDaemon(mountpoint string) int {
+	if err := os.MkdirAll(stateDir(), 0o700); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if st, err := readState(statePath(mountpoint, ".json")); err == nil && processRunning(st.Pid) {
+		fmt.Fprintf(os.Stderr, "%s is already mounted by pid %d\n", mountpoint, st.Pid)
+		return exitError
+	}
+	logPath := statePath(mountpoint, ".log")
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	defer logFile.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	cmd := reexec("supervisor", logFile, w)
+	cmd.Env = append(cmd.Env, logEnv+"="+logPath)
+	/* its own session, so that closing the terminal doesn't kill it */
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	w.Close()
+	msg, _ := bufio.NewReader(r).ReadString('\n')
+	msg = strings.TrimSpace(msg)
+	if msg != "ready" {
+		if msg == "" {
+			msg = "the server exited"
+		}
+		fmt.Fprintf(os.Stderr, "Couldn't mount %s: %s\n", mountpoint, strings.TrimPrefix(msg, "error: "))
+		fmt.Fprintf(os.Stderr, "The log is in %s\n", logPath)
+		return exitError
+	}
+	fmt.Printf("Mounted %s in the background, the log is in %s\n", mountpoint, logPath)
+	fmt.Printf("Run `%s unmount %s` to stop\n", filepath.Base(os.Args[0]), mountpoint)
+	return exitOK
+}
+
+/* runs the server, and cleans up after it no matter how it exits */
+func supervise(mountpoint string) int {
+	ready := os.NewFile(3, "ready")
+	cmd := reexec("server", os.Stdout, ready)
+	if err := cmd.Start(); err != nil {
+		sendReady(ready, err)
+		log.Print(err)
+		return exitError
+	}
+	ready.Close()
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigchan {
+			cmd.Process.Signal(sig)
+		}
+	}()
+	err := cmd.Wait()
+	if err != nil {
+		log.Printf("server exited: %s", err)
+	}
+	if isMounted(mountpoint) {
+		log.Printf("%s is still mounted, unmounting it", mountpoint)
+		if err := unmount(mountpoint); err != nil {
+			log.Print(err)
+		}
+	}
+	removeState(mountpoint)
+	if err != nil {
+		return exitError
+	}
+	return exitOK
+}
+
+/* git-commit-folders unmount <mountpoint> */
+func unmountCommand(c *command, args []string) int {
+	positional, code, ok := c.parse(nil, args, 1)
+	if !ok {
+		return code
+	}
+	mountpoint := positional[0]
+	st, err := readState(statePath(mountpoint, ".json"))
+	if err != nil && !isMounted(mountpoint) {
+		fmt.Fprintf(os.Stderr, "%s isn't mounted\n", mountpoint)
+		return exitError
+	}
+	/* ask the server to unmount & exit by itself first */
+	if st != nil && processRunning(st.Pid) {
+		syscall.Kill(st.Pid, syscall.SIGTERM)
+		for i := 0; i < 100 && processRunning(st.Pid); i++ {
+			time.Sleep(50 * time.Millisecond)
+		}
+		if processRunning(st.Pid) {
+			log.Printf("pid %d didn't exit, unmounting anyway", st.Pid)
+		}
+	}
+	if isMounted(mountpoint) {
+		if err := unmount(mountpoint); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+	}
+	removeState(mountpoint)
+	fmt.Printf("Unmounted %s\n", mountpoint)
+	return exitOK
+}
+
+type mountStatus struct {
+	*mountState
+	running bool
+	mounted bool
+}
+
+/*
+every mount that has a state file (or just `mountpoint`'s). Ones that are
+completely gone get their state file deleted and aren't returned
+*/
+func mounts(mountpoint string) []mountStatus {
+	paths, _ := filepath.Glob(filepath.Join(stateDir(), "*.json"))
+	if mountpoint != "" {
+		paths = []string{statePath(mountpoint, ".json")}
+	}
+	var result []mountStatus
+	for _, path := range paths {
+		st, err := readState(path)
+		if err != nil {
+			continue
+		}
+		m := mountStatus{st, processRunning(st.Pid), isMounted(st.Mountpoint)}
+		if !m.running && !m.mounted {
+			/* it's gone and cleaned up after itself (or someone else did) */
+			os.Remove(path)
+			continue
+		}
+		result = append(result, m)
+	}
+	return result
+}
+
+/* git-commit-folders list [mountpoint] */
+func listCommand(c *command, args []string) int {
+	positional, code, ok := c.parse(nil, args, 0, 1)
+	if !ok {
+		return code
+	}
+	mountpoint := ""
+	if len(positional) == 1 {
+		mountpoint = positional[0]
+	}
+	all := mounts(mountpoint)
+	for _, m := range all {
+		fmt.Printf("%s\n", m.Mountpoint)
+		fmt.Printf("  pid:     %d (%s)\n", m.Pid, describe(m.running, "running", "not running"))
+		fmt.Printf("  mounted: %s\n", describe(m.mounted, "yes", "no"))
+		fmt.Printf("  since:   %s\n", m.Started.Format(time.RFC1123))
+		fmt.Printf("  command: %s\n", strings.Join(m.Args, " "))
+		if m.Log != "" {
+			fmt.Printf("  log:     %s\n", m.Log)
+		}
+		if !m.running {
+			fmt.Printf("  the server is gone, run `%s unmount %s` to clean up\n", filepath.Base(os.Args[0]), m.Mountpoint)
+		}
+	}
+	if mountpoint != "" {
+		if len(all) == 0 {
+			fmt.Printf("%s isn't mounted\n", mountpoint)
+		}
+		if len(all) == 0 || !all[0].running || !all[0].mounted {
+			return exitError
+		}
+	} else if len(all) == 0 {
+		fmt.Println("Nothing is mounted")
+	}
+	return exitOK
+}
+
+func describe(b bool, yes, no string) string {
+	if b {
+		return yes
+	}
+	return no
+}
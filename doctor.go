@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+)
+
+/*
+  `git-commit-folders doctor`: what's probably wrong when a mount doesn't
+  work. Every -type needs something different from the OS, so we check for
+  each of them and say which ones should work here.
+
+  These are just guesses (we don't actually try to mount anything), but they
+  catch the usual things: no /dev/fuse in a container, no NFS client
+  installed, not being root.
+*/
+
+type checker struct {
+	problems int
+}
+
+func (c *checker) ok(format string, args ...interface{}) {
+	fmt.Printf("  ok       "+format+"\n", args...)
+}
+
+func (c *checker) problem(format string, args ...interface{}) {
+	c.problems++
+	fmt.Printf("  problem  "+format+"\n", args...)
+}
+
+/* a mount type that can't work isn't a problem unless none of them can */
+func (c *checker) missing(format string, args ...interface{}) {
+	fmt.Printf("  missing  "+format+"\n", args...)
+}
+
+/* git-commit-folders doctor [flags] */
+func doctorCommand(cmd *command, args []string) int {
+	var opts options
+	if _, code, ok := cmd.parse(&opts, args, 0); !ok {
+		return code
+	}
+	c := &checker{}
+
+	fmt.Println("repository")
+	if _, err := git.PlainOpen(opts.repoDir); err != nil {
+		c.problem("%s: %s", opts.repoDir, err)
+	} else {
+		c.ok("%s is a git repository", absPath(opts.repoDir))
+	}
+
+	fmt.Println("mount types")
+	works := 0
+	for _, check := range []func(*checker) bool{checkFuse, checkNFS, checkWebDAV, check9P} {
+		if check(c) {
+			works++
+		}
+	}
+	if works == 0 {
+		c.problem("none of the mount types will work, but `serve` still does")
+	}
+
+	fmt.Println("mounts")
+	if err := os.MkdirAll(stateDir(), 0o700); err != nil {
+		c.problem("can't keep track of mounts in %s: %s", stateDir(), err)
+	} else {
+		c.ok("keeping track of mounts in %s", stateDir())
+	}
+	for _, m := range mounts("") {
+		if m.running {
+			c.ok("%s is mounted by pid %d", m.Mountpoint, m.Pid)
+		} else {
+			c.problem("%s is still mounted, but its server is gone (run `%s unmount %s`)", m.Mountpoint, filepath.Base(os.Args[0]), m.Mountpoint)
+		}
+	}
+
+	if c.problems > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+func checkFuse(c *checker) bool {
+	if runtime.GOOS == "darwin" {
+		if _, err := os.Stat("/Library/Filesystems/macfuse.fs"); err != nil {
+			c.missing("fuse: macFUSE isn't installed (https://osxfuse.github.io)")
+			return false
+		}
+		c.ok("fuse: macFUSE is installed")
+		return true
+	}
+	if _, err := os.Stat("/dev/fuse"); err != nil {
+		c.missing("fuse: there's no /dev/fuse (in a container, try --device /dev/fuse)")
+		return false
+	}
+	if !hasCommand("fusermount", "fusermount3") {
+		c.missing("fuse: fusermount isn't installed (it's in the fuse or fuse3 package)")
+		return false
+	}
+	c.ok("fuse")
+	return true
+}
+
+func checkNFS(c *checker) bool {
+	if !hasCommand("mount") {
+		c.missing("nfs: there's no mount command")
+		return false
+	}
+	if runtime.GOOS != "linux" {
+		c.ok("nfs")
+		return true
+	}
+	if !hasFilesystem("nfs") && !hasCommand("mount.nfs") {
+		c.missing("nfs: no NFS client (it's in nfs-common or nfs-utils)")
+		return false
+	}
+	if os.Geteuid() != 0 {
+		c.missing("nfs: mounting NFS needs root on Linux")
+		return false
+	}
+	c.ok("nfs")
+	return true
+}
+
+func checkWebDAV(c *checker) bool {
+	if runtime.GOOS == "darwin" {
+		c.ok("webdav")
+		return true
+	}
+	if !hasCommand("mount.davfs") {
+		c.missing("webdav: davfs2 isn't installed")
+		return false
+	}
+	c.ok("webdav")
+	return true
+}
+
+func check9P(c *checker) bool {
+	if runtime.GOOS != "linux" {
+		c.missing("9p: only works on Linux")
+		return false
+	}
+	if !hasFilesystem("9p") {
+		c.missing("9p: the kernel doesn't have 9p (try `modprobe 9p`)")
+		return false
+	}
+	if os.Geteuid() != 0 {
+		c.missing("9p: mounting 9p needs root")
+		return false
+	}
+	c.ok("9p")
+	return true
+}
+
+func hasCommand(names ...string) bool {
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err == nil {
+			return true
+		}
+		/* mount helpers are often in /sbin, which isn't always in $PATH */
+		for _, dir := range []string{"/sbin", "/usr/sbin"} {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* the filesystems the kernel knows about right now */
+func hasFilesystem(name string) bool {
+	content, err := os.ReadFile("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[len(fields)-1] == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,227 @@
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+/*
+  actions/ lets you do a few things to branches by making symlinks (only with
+  -writable-refs):
+
+  $ ln -s ../../commits/ab/abcd/<hash> actions/cherry-pick-onto/release-1.2/
+  $ ln -s ../../commits/ab/abcd/<hash> actions/revert-onto/main/
+  $ ln -s ../../commits/ab/abcd/<hash> actions/fast-forward/main/
+
+  If it doesn't work (like if there's a conflict), the symlink fails with EIO
+  and the reason goes in actions/<action>/<branch>/error. Everything that
+  happens gets written to actions/log.
+*/
+
+var actionNames = []string{"cherry-pick-onto", "revert-onto", "fast-forward"}
+
+type Actions struct {
+	repo *git.Repository
+	refs *refWriter
+	lock sync.Mutex
+	log  []byte
+	/* the last error for each action/branch */
+	errors map[string][]byte
+}
+
+type ActionsDir struct {
+	actions *Actions
+}
+
+type ActionDir struct {
+	actions *Actions
+	action  string
+}
+
+type ActionBranchDir struct {
+	actions *Actions
+	action  string
+	branch  string
+}
+
+func newActions(repo *git.Repository, refs *refWriter) *Actions {
+	return &Actions{
+		repo:   repo,
+		refs:   refs,
+		errors: make(map[string][]byte),
+	}
+}
+
+func (d *ActionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/actions")
+	return nil
+}
+
+func (d *ActionsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	for _, name := range actionNames {
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	entries = append(entries, fuse.Dirent{Name: "log", Type: fuse.DT_File})
+	return entries, nil
+}
+
+func (d *ActionsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == "log" {
+		return &TextFile{content: d.actions.auditLog(), path: "/actions/log"}, nil
+	}
+	for _, action := range actionNames {
+		if name == action {
+			return &ActionDir{actions: d.actions, action: action}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *ActionDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/actions/" + d.action)
+	return nil
+}
+
+/* one folder per branch */
+func (d *ActionDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	branches, err := d.actions.repo.Branches()
+	if err != nil {
+		return nil, err
+	}
+	branches.ForEach(func(branch *plumbing.Reference) error {
+		entries = append(entries, fuse.Dirent{
+			Name: branch.Name().Short(),
+			Type: fuse.DT_Dir,
+		})
+		return nil
+	})
+	return entries, nil
+}
+
+func (d *ActionDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if _, err := d.actions.repo.Reference(plumbing.NewBranchReferenceName(name), true); err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &ActionBranchDir{actions: d.actions, action: d.action, branch: name}, nil
+}
+
+func (d *ActionBranchDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o755
+	a.Inode = inode("/actions/" + d.action + "/" + d.branch)
+	return nil
+}
+
+func (d *ActionBranchDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	if d.actions.lastError(d.action, d.branch) == nil {
+		return []fuse.Dirent{}, nil
+	}
+	return []fuse.Dirent{{Name: "error", Type: fuse.DT_File}}, nil
+}
+
+func (d *ActionBranchDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	content := d.actions.lastError(d.action, d.branch)
+	if name != "error" || content == nil {
+		return nil, fuse.ENOENT
+	}
+	return &TextFile{content: content, path: "/actions/" + d.action + "/" + d.branch + "/error"}, nil
+}
+
+func (d *ActionBranchDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if err := d.actions.run(d.action, d.branch, req.Target); err != nil {
+		/* EINVAL & friends are more useful than EIO if we have them */
+		var errno fuse.ErrorNumber
+		if errors.As(err, &errno) {
+			return nil, err
+		}
+		return nil, fuse.EIO
+	}
+	return &SymLink{req.Target, "/actions/" + d.action + "/" + d.branch + "/" + req.NewName}, nil
+}
+
+func (a *Actions) run(action, branch, target string) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	var hash, old, next plumbing.Hash
+	err := func() (err error) {
+		hash, err = commitFromLinkTarget(a.repo, target)
+		if err != nil {
+			return err
+		}
+		ref, err := a.repo.Reference(name, true)
+		if err != nil {
+			return err
+		}
+		old = ref.Hash()
+		next, err = a.apply(action, old, hash)
+		if err != nil {
+			return err
+		}
+		return a.refs.updateFrom(name, old, next)
+	}()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	key := action + "/" + branch
+	timestamp := time.Now().Format(time.RFC3339)
+	if err != nil {
+		message := fmt.Sprintf("%s %s %s: %s\n", action, branch, target, err)
+		a.errors[key] = []byte(message)
+		a.log = append(a.log, timestamp+" error: "+message...)
+		log.Print(message)
+		return err
+	}
+	delete(a.errors, key)
+	a.log = append(a.log, fmt.Sprintf("%s %s %s %s: %s -> %s\n", timestamp, action, branch, hash, old, next)...)
+	return nil
+}
+
+/* returns what the branch should point to next */
+func (a *Actions) apply(action string, tip, hash plumbing.Hash) (plumbing.Hash, error) {
+	if action == "fast-forward" {
+		ok, err := isAncestor(a.repo, tip, hash)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if !ok {
+			return plumbing.ZeroHash, fmt.Errorf("can't fast-forward: %s isn't a descendant of %s", hash, tip)
+		}
+		return hash, nil
+	}
+	onto, err := a.repo.CommitObject(tip)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	commit, err := a.repo.CommitObject(hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if action == "revert-onto" {
+		return revert(a.repo, onto, commit)
+	}
+	return cherryPick(a.repo, onto, commit)
+}
+
+func (a *Actions) auditLog() []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]byte{}, a.log...)
+}
+
+func (a *Actions) lastError(action, branch string) []byte {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.errors[action+"/"+branch]
+}
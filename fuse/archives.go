@@ -0,0 +1,397 @@
+package fuse
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  archives/ has a .tar, .tar.gz and .zip for every branch and tag, like
+  `git archive`:
+
+  $ cat archives/v1.2.3.tar.gz > release.tgz
+
+  You can also ask for a commit hash (archives/<hash>.zip) even though those
+  aren't listed. The archives are made while you read them, so they're never
+  all in memory, and they're the same every time: every file's mtime is the
+  commit's date, and it doesn't depend on when you made the archive.
+
+  We don't know how big an archive is until we've made it, so FUSE reads them
+  with direct IO until the end. NFS, 9P and SFTP clients need the size up
+  front, so the adapters call Size, which makes the archive once to count its
+  bytes. Commits never change, so we remember the size for each commit and
+  format and Attr reports it after that.
+*/
+
+var archiveFormats = []string{".tar.gz", ".tar", ".zip"}
+
+type archiveKey struct {
+	commit plumbing.Hash
+	format string
+}
+
+/* a few numbers each, so this can be big */
+const maxArchiveSizes = 10000
+
+var archiveSizes = make(map[archiveKey]int64)
+var archiveSizesLock sync.Mutex
+
+type ArchivesDir struct {
+	repo *git.Repository
+}
+
+type ArchiveFile struct {
+	repo   *git.Repository
+	commit plumbing.Hash
+	format string
+	path   string
+	mtime  time.Time
+}
+
+func (d *ArchivesDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Mtime = time.Unix(0, 0)
+	a.Ctime = time.Unix(0, 0)
+	a.Inode = inode("/archives")
+	return nil
+}
+
+func (d *ArchivesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	add := func(ref *plumbing.Reference) error {
+		for _, ext := range archiveFormats {
+			entries = append(entries, fuse.Dirent{Name: ref.Name().Short() + ext, Type: fuse.DT_File})
+		}
+		return nil
+	}
+	tags, err := d.repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tags.ForEach(add)
+	branches, err := d.repo.Branches()
+	if err != nil {
+		return nil, err
+	}
+	branches.ForEach(add)
+	return entries, nil
+}
+
+func (d *ArchivesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	for _, ext := range archiveFormats {
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		commit, err := resolveRev(d.repo, strings.TrimSuffix(name, ext))
+		if err != nil {
+			return nil, fuse.ENOENT
+		}
+		return &ArchiveFile{
+			repo:   d.repo,
+			commit: commit.Hash,
+			format: ext,
+			path:   "/archives/" + name,
+			mtime:  commit.Committer.When,
+		}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+/* a tag, branch or commit hash. Tags first, like git does */
+func resolveRev(repo *git.Repository, rev string) (*object.Commit, error) {
+	for _, prefix := range []string{"refs/tags/", "refs/heads/"} {
+		ref, err := repo.Reference(plumbing.ReferenceName(prefix+rev), true)
+		if err == nil {
+			return repo.CommitObject(peelTag(repo, ref.Hash()))
+		}
+	}
+	if len(rev) != 40 {
+		return nil, fuse.ENOENT
+	}
+	return repo.CommitObject(plumbing.NewHash(rev))
+}
+
+func (f *ArchiveFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	a.Mtime = f.mtime
+	a.Ctime = f.mtime
+	a.Inode = inode(f.path)
+	/* only if we already know it, see Size */
+	archiveSizesLock.Lock()
+	a.Size = uint64(archiveSizes[archiveKey{f.commit, f.format}])
+	archiveSizesLock.Unlock()
+	return nil
+}
+
+/* makes the archive (without keeping it) to find out how big it is */
+func (f *ArchiveFile) Size(ctx context.Context) (uint64, error) {
+	key := archiveKey{f.commit, f.format}
+	archiveSizesLock.Lock()
+	size, ok := archiveSizes[key]
+	archiveSizesLock.Unlock()
+	if ok {
+		return uint64(size), nil
+	}
+	n := &countingWriter{w: io.Discard}
+	if err := f.write(n); err != nil {
+		return 0, err
+	}
+	archiveSizesLock.Lock()
+	if len(archiveSizes) >= maxArchiveSizes {
+		archiveSizes = make(map[archiveKey]int64)
+	}
+	archiveSizes[key] = n.n
+	archiveSizesLock.Unlock()
+	return uint64(n.n), nil
+}
+
+func (f *ArchiveFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	return &archiveHandle{write: f.write}, nil
+}
+
+func (f *ArchiveFile) write(w io.Writer) error {
+	commit, err := f.repo.CommitObject(f.commit)
+	if err != nil {
+		return err
+	}
+	a := &archiver{repo: f.repo, mtime: commit.Committer.When}
+	switch f.format {
+	case ".tar.gz":
+		gz := gzip.NewWriter(w)
+		if err := a.writeTar(gz, commit.TreeHash, commit.Hash.String()); err != nil {
+			return err
+		}
+		return gz.Close()
+	case ".tar":
+		return a.writeTar(w, commit.TreeHash, commit.Hash.String())
+	}
+	return a.writeZip(w, commit.Hash, commit.TreeHash)
+}
+
+/*
+An open archive. Reads almost always come in order, so we keep making the
+archive in a goroutine and hand out the next bytes. If someone seeks, we
+start again from the beginning, which is slow but works.
+*/
+type archiveHandle struct {
+	write  func(io.Writer) error
+	lock   sync.Mutex
+	reader *io.PipeReader
+	offset int64
+}
+
+func (h *archiveHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.reader == nil || req.Offset < h.offset {
+		h.restart()
+	}
+	if req.Offset > h.offset {
+		n, err := io.CopyN(io.Discard, h.reader, req.Offset-h.offset)
+		h.offset += n
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, req.Size)
+	n, err := io.ReadFull(h.reader, buf)
+	h.offset += int64(n)
+	resp.Data = buf[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+func (h *archiveHandle) restart() {
+	if h.reader != nil {
+		h.reader.Close()
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(h.write(w))
+	}()
+	h.reader = r
+	h.offset = 0
+}
+
+func (h *archiveHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.reader != nil {
+		/* stops the goroutine */
+		h.reader.Close()
+	}
+	return nil
+}
+
+/* the modes are what `git archive` uses with its default umask (002) */
+type archiver struct {
+	repo  *git.Repository
+	mtime time.Time
+}
+
+type archiveEntry struct {
+	name string
+	mode filemode.FileMode
+	id   plumbing.Hash
+}
+
+/* every file in the tree, depth first, in the same order as git */
+func (a *archiver) walk(id plumbing.Hash, prefix string, fn func(archiveEntry) error) error {
+	tree, err := getTree(a.repo, id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree.Entries {
+		e := archiveEntry{name: prefix + entry.Name, mode: entry.Mode, id: entry.Hash}
+		switch entry.Mode {
+		case filemode.Dir:
+			e.name += "/"
+			if err := fn(e); err != nil {
+				return err
+			}
+			if err := a.walk(entry.Hash, e.name, fn); err != nil {
+				return err
+			}
+		case filemode.Regular, filemode.Deprecated, filemode.Executable, filemode.Symlink:
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		/* git archive skips submodules too */
+	}
+	return nil
+}
+
+func (a *archiver) blob(id plumbing.Hash) (plumbing.EncodedObject, error) {
+	return a.repo.Storer.EncodedObject(plumbing.BlobObject, id)
+}
+
+func (e archiveEntry) perm() os.FileMode {
+	switch e.mode {
+	case filemode.Dir, filemode.Executable:
+		return 0o775
+	case filemode.Symlink:
+		return 0o777
+	}
+	return 0o664
+}
+
+/*
+git archive puts the commit in a pax header (`git get-tar-commit-id` reads
+it), leave `comment` empty to skip it
+*/
+func (a *archiver) writeTar(w io.Writer, tree plumbing.Hash, comment string) error {
+	tw := tar.NewWriter(w)
+	if comment != "" {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": comment},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := a.walk(tree, "", func(e archiveEntry) error {
+		hdr := &tar.Header{
+			Name:    e.name,
+			Mode:    int64(e.perm()),
+			ModTime: a.mtime,
+			Uname:   "root",
+			Gname:   "root",
+		}
+		var obj plumbing.EncodedObject
+		switch e.mode {
+		case filemode.Dir:
+			hdr.Typeflag = tar.TypeDir
+		case filemode.Symlink:
+			hdr.Typeflag = tar.TypeSymlink
+			content, err := readBlob(a.repo, e.id)
+			if err != nil {
+				return err
+			}
+			hdr.Linkname = string(content)
+		default:
+			hdr.Typeflag = tar.TypeReg
+			var err error
+			if obj, err = a.blob(e.id); err != nil {
+				return err
+			}
+			hdr.Size = obj.Size()
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if obj == nil {
+			return nil
+		}
+		return copyObject(tw, obj)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (a *archiver) writeZip(w io.Writer, commit, tree plumbing.Hash) error {
+	zw := zip.NewWriter(w)
+	/* git archive does this too */
+	if err := zw.SetComment(commit.String()); err != nil {
+		return err
+	}
+	err := a.walk(tree, "", func(e archiveEntry) error {
+		hdr := &zip.FileHeader{Name: e.name, Method: zip.Deflate, Modified: a.mtime}
+		mode := e.perm()
+		switch e.mode {
+		case filemode.Dir:
+			mode |= os.ModeDir
+			hdr.Method = zip.Store
+		case filemode.Symlink:
+			mode |= os.ModeSymlink
+			hdr.Method = zip.Store
+		}
+		hdr.SetMode(mode)
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil || e.mode == filemode.Dir {
+			return err
+		}
+		obj, err := a.blob(e.id)
+		if err != nil {
+			return err
+		}
+		return copyObject(fw, obj)
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyObject(w io.Writer, obj plumbing.EncodedObject) error {
+	reader, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
@@ -0,0 +1,167 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+/*
+  blame/<hash>/ mirrors commits/ab/abcd/<hash>/, except that every file
+  contains `git blame` output for that file at that commit instead of the
+  file itself.
+*/
+
+type BlameDir struct {
+	repo *git.Repository
+}
+
+type BlameTree struct {
+	repo   *git.Repository
+	commit plumbing.Hash
+	path   string
+	id     plumbing.Hash
+}
+
+type BlameFile struct {
+	repo   *git.Repository
+	commit plumbing.Hash
+	path   string
+}
+
+func (f *BlameDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/blame")
+	return nil
+}
+
+func (f *BlameDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	/* listing every commit here would be way too slow, use commits/ for that */
+	return []fuse.Dirent{}, nil
+}
+
+func (f *BlameDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	commit, err := f.repo.CommitObject(plumbing.NewHash(name))
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &BlameTree{repo: f.repo, commit: commit.Hash, path: "", id: commit.TreeHash}, nil
+}
+
+func (t *BlameTree) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/blame/" + t.commit.String() + "/" + t.path)
+	return nil
+}
+
+func (t *BlameTree) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	tree, err := getTree(t.repo, t.id)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for _, entry := range tree.Entries {
+		switch entry.Mode {
+		case filemode.Dir:
+			entries = append(entries, fuse.Dirent{Name: entry.Name, Type: fuse.DT_Dir})
+		case filemode.Regular, filemode.Executable:
+			entries = append(entries, fuse.Dirent{Name: entry.Name, Type: fuse.DT_File})
+		}
+		/* blaming symlinks and submodules doesn't make sense */
+	}
+	return entries, nil
+}
+
+func (t *BlameTree) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	tree, err := getTree(t.repo, t.id)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", name, err)
+	}
+	if entry, ok := tree.entry(name); ok {
+		switch entry.Mode {
+		case filemode.Dir:
+			return &BlameTree{repo: t.repo, commit: t.commit, path: path.Join(t.path, name), id: entry.Hash}, nil
+		case filemode.Regular, filemode.Executable:
+			return &BlameFile{repo: t.repo, commit: t.commit, path: path.Join(t.path, name)}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+/*
+the blame only gets computed when someone reads the file, so that `ls -l`
+doesn't blame every file in the directory. Until then we don't know the
+size, so it's opened with direct IO (like archives/)
+*/
+func (f *BlameFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	a.Mtime = time.Unix(0, 0)
+	a.Ctime = time.Unix(0, 0)
+	a.Inode = inode("/blame/" + f.commit.String() + "/" + f.path)
+	blameCacheLock.Lock()
+	a.Size = uint64(len(blameCache[blameKey(f.commit, f.path)]))
+	blameCacheLock.Unlock()
+	return nil
+}
+
+func (f *BlameFile) Size(ctx context.Context) (uint64, error) {
+	content, err := blameFile(f.repo, f.commit, f.path)
+	return uint64(len(content)), err
+}
+
+func (f *BlameFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	return f, nil
+}
+
+func (f *BlameFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return blameFile(f.repo, f.commit, f.path)
+}
+
+/*
+blame is slow, but the blame for a path at a given commit never changes, so
+we cache every result by (commit, path)
+*/
+var blameCache = make(map[string][]byte)
+var blameCacheLock sync.Mutex
+
+func blameKey(id plumbing.Hash, filename string) string {
+	return id.String() + ":" + filename
+}
+
+func blameFile(repo *git.Repository, id plumbing.Hash, filename string) ([]byte, error) {
+	key := blameKey(id, filename)
+	blameCacheLock.Lock()
+	content, ok := blameCache[key]
+	blameCacheLock.Unlock()
+	if ok {
+		return content, nil
+	}
+
+	commit, err := repo.CommitObject(id)
+	if err != nil {
+		return nil, err
+	}
+	result, err := git.Blame(commit, filename)
+	if err != nil {
+		return nil, fmt.Errorf("blame %s: %w", filename, err)
+	}
+	content = []byte(result.String())
+
+	blameCacheLock.Lock()
+	if len(blameCache) > 1000 {
+		blameCache = make(map[string][]byte)
+	}
+	blameCache[key] = content
+	blameCacheLock.Unlock()
+	return content, nil
+}
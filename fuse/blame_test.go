@@ -0,0 +1,35 @@
+package fuse
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/fuse"
+)
+
+func TestBlameLazy(t *testing.T) {
+	repo, hashes := testRepo(t, map[string]string{"a.txt": "hello\n"})
+	dir := &BlameDir{repo: repo}
+	ctx := context.Background()
+	tree, err := dir.Lookup(ctx, hashes[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := tree.(*BlameTree).Lookup(ctx, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := node.(*BlameFile)
+	var a fuse.Attr
+	if err := file.Attr(ctx, &a); err != nil || a.Size != 0 {
+		t.Errorf("blamed it before anyone read it: size %d, %v", a.Size, err)
+	}
+	content, err := file.ReadAll(ctx)
+	if err != nil || !strings.Contains(string(content), "hello") {
+		t.Errorf("ReadAll: %q, %v", content, err)
+	}
+	if err := file.Attr(ctx, &a); err != nil || a.Size != uint64(len(content)) {
+		t.Errorf("size after reading: %d, %v", a.Size, err)
+	}
+}
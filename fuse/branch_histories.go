@@ -12,12 +12,14 @@ import (
 )
 
 type BranchHistoriesDir struct {
-	repo *git.Repository
+	repo    *git.Repository
+	changes *refChanges
 }
 
 type BranchHistoryDir struct {
-	repo   *git.Repository
-	branch string
+	repo    *git.Repository
+	branch  string
+	changes *refChanges
 }
 
 func (f *BranchHistoriesDir) Root() (fs.Node, error) {
@@ -26,6 +28,8 @@ func (f *BranchHistoriesDir) Root() (fs.Node, error) {
 
 func (f *BranchHistoriesDir) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0o555
+	a.Mtime = f.changes.mtime("/branch_histories")
+	a.Ctime = a.Mtime
 	a.Inode = inode("/branch_histories")
 	return nil
 }
@@ -52,11 +56,14 @@ func (f *BranchHistoriesDir) Lookup(ctx context.Context, name string) (fs.Node,
 	if err != nil {
 		return nil, fuse.ENOENT
 	}
-	return &BranchHistoryDir{repo: f.repo, branch: name}, nil
+	dir := &BranchHistoryDir{repo: f.repo, branch: name, changes: f.changes}
+	return f.changes.lookedUp("/branch_histories/"+name, dir), nil
 }
 
 func (f *BranchHistoryDir) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0o555
+	a.Mtime = f.changes.mtime("/branch_histories/" + f.branch)
+	a.Ctime = a.Mtime
 	a.Inode = inode("/branch_histories/" + f.branch)
 	return nil
 }
@@ -96,5 +103,5 @@ func (f *BranchHistoryDir) Lookup(ctx context.Context, name string) (fs.Node, er
 	if err != nil {
 		return nil, fuse.ENOENT
 	}
-	return &SymLink{"../../" + commitPath(hash)}, nil
+	return &SymLink{"../../" + commitPath(hash), "/branch_histories/" + f.branch + "/" + name}, nil
 }
@@ -3,7 +3,7 @@ package fuse
 import (
 	"context"
 	"os"
-	"time"
+	"syscall"
 
 	"github.com/anacrolix/fuse"
 	"github.com/anacrolix/fuse/fs"
@@ -13,6 +13,9 @@ import (
 
 type BranchesDir struct {
 	repo *git.Repository
+	/* nil unless the mount has -writable-refs */
+	refs    *refWriter
+	changes *refChanges
 }
 
 func (f *BranchesDir) Root() (fs.Node, error) {
@@ -21,8 +24,11 @@ func (f *BranchesDir) Root() (fs.Node, error) {
 
 func (f *BranchesDir) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0o555
-	a.Mtime = time.Unix(0, 0)
-	a.Ctime = time.Unix(0, 0)
+	if f.refs != nil {
+		a.Mode = os.ModeDir | 0o755
+	}
+	a.Mtime = f.changes.mtime("/branches")
+	a.Ctime = a.Mtime
 	a.Inode = inode("/branches")
 	return nil
 }
@@ -48,7 +54,48 @@ func (f *BranchesDir) Lookup(ctx context.Context, name string) (fs.Node, error)
 	if err != nil {
 		return nil, fuse.ENOENT
 	}
+	if f.refs != nil {
+		f.refs.saw(ref.Name(), ref.Hash())
+	}
 	/* return a symlink to ../commits/<hash> */
 	id := ref.Hash().String()
-	return &SymLink{"../" + commitPath(id)}, nil
+	link := &RefSymLink{SymLink{"../" + commitPath(id), "/branches/" + name}, f.changes.mtime("/branches/" + name)}
+	return f.changes.lookedUp("/branches/"+name, link), nil
+}
+
+/* ln -s ../commits/ab/abcd/<hash> branches/newbranch */
+func (f *BranchesDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if f.refs == nil {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	hash, err := commitFromLinkTarget(f.repo, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.refs.create(plumbing.NewBranchReferenceName(req.NewName), hash); err != nil {
+		return nil, err
+	}
+	return &SymLink{"../" + commitPath(hash.String()), "/branches/" + req.NewName}, nil
+}
+
+/* rm branches/oldbranch */
+func (f *BranchesDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if f.refs == nil {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return f.refs.remove(plumbing.NewBranchReferenceName(req.Name))
+}
+
+/*
+`ln -sf` creates the new symlink with a temporary name and then renames it
+over the old one, so that's how branches get moved
+*/
+func (f *BranchesDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if f.refs == nil {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if _, ok := newDir.(*BranchesDir); !ok {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	return f.refs.rename(plumbing.NewBranchReferenceName(req.OldName), plumbing.NewBranchReferenceName(req.NewName))
 }
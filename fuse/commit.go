@@ -6,6 +6,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/anacrolix/fuse"
@@ -15,23 +17,28 @@ import (
 	git "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/storer"
 )
 
 type CommitsDir struct {
 	repo *git.Repository
+	/* nil unless -hardlink-blobs, see hardlinks.go */
+	links *blobLinks
 }
 
 type CommitsPrefixDir struct {
 	/* /commits/af */
 	repo   *git.Repository
 	prefix string
+	links  *blobLinks
 }
 
 type CommitsPrefixDir2 struct {
 	/* /commits/af/afee */
 	repo   *git.Repository
 	prefix string
+	links  *blobLinks
 }
 
 func (f *CommitsDir) Root() (fs.Node, error) {
@@ -59,7 +66,11 @@ type CommitsCache struct {
 	expiry  time.Time
 }
 
-var cachedCommits *CommitsCache
+var cachedCommits = &CommitsCache{commits: make(map[string]map[string]map[string]bool)}
+
+/* the cache gets read by every lookup while getPackedCommits & getCommits add to it */
+var cachedCommitsLock sync.Mutex
+var packedCommits sync.Once
 
 func addToCache(item plumbing.Hash) error {
 	id := item.String()
@@ -77,7 +88,7 @@ func addToCache(item plumbing.Hash) error {
 
 /*
 Just iterate over the full repo once at the beginning (called in `root.go`), otherwise only look at
-the loose objects.
+the loose objects. Everyone else waits until it's done.
 
 This assumes two false things:
 * repos never get repacked
@@ -85,57 +96,112 @@ This assumes two false things:
 
 hopefully they're true enough most of the time though
 */
-func getPackedCommits(repo *git.Repository) error {
-	if cachedCommits != nil {
-		return nil
+func getPackedCommits(repo *git.Repository) {
+	packedCommits.Do(func() {
+		iter, err := repo.Storer.IterEncodedObjects(plumbing.CommitObject)
+		if err != nil {
+			log.Printf("error: can't get commits: %v", err)
+			return
+		}
+		var ids []plumbing.Hash
+		iter.ForEach(func(obj plumbing.EncodedObject) error {
+			ids = append(ids, obj.Hash())
+			return nil
+		})
+		cachedCommitsLock.Lock()
+		defer cachedCommitsLock.Unlock()
+		for _, id := range ids {
+			addToCache(id)
+		}
+		log.Printf("Done caching packed commits")
+	})
+}
+
+/* look for new loose commits, if it's been a while */
+func getCommits(repo *git.Repository) {
+	getPackedCommits(repo)
+	cachedCommitsLock.Lock()
+	expired := cachedCommits.expiry.Before(time.Now())
+	if expired {
+		/* so that nobody else starts looking at the same time */
+		cachedCommits.expiry = time.Now().Add(time.Minute)
 	}
-	objStorer := repo.Storer
-	iter, err := objStorer.IterEncodedObjects(plumbing.CommitObject)
-	if err != nil {
-		return err
+	cachedCommitsLock.Unlock()
+	if !expired {
+		return
+	}
+	los, ok := repo.Storer.(storer.LooseObjectStorer)
+	if !ok {
+		log.Fatal("can't get loose objects")
 	}
-	cachedCommits = &CommitsCache{commits: make(map[string]map[string]map[string]bool)}
-	iter.ForEach(func(obj plumbing.EncodedObject) error {
-		return addToCache(obj.Hash())
+	start := time.Now()
+	var ids []plumbing.Hash
+	los.ForEachObjectHash(func(hash plumbing.Hash) error {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil
+		}
+		ids = append(ids, commit.Hash)
+		return nil
 	})
-	log.Printf("Done caching packed commits")
-	return nil
+	elapsed := time.Since(start)
+	cacheDuration := elapsed * 20
+	if cacheDuration > 1*time.Minute {
+		cacheDuration = 1 * time.Minute
+	}
+	cachedCommitsLock.Lock()
+	defer cachedCommitsLock.Unlock()
+	for _, id := range ids {
+		addToCache(id)
+	}
+	cachedCommits.expiry = time.Now().Add(cacheDuration)
 }
 
-func getCommits(repo *git.Repository) (map[string]map[string]map[string]bool, error) {
-	getPackedCommits(repo)
-	if cachedCommits.expiry.Before(time.Now()) {
-		if los, ok := repo.Storer.(storer.LooseObjectStorer); ok {
-			start := time.Now()
-			los.ForEachObjectHash(func(hash plumbing.Hash) error {
-				commit, err := repo.CommitObject(hash)
-				if err != nil {
-					return nil
-				}
-				addToCache(commit.Hash)
-				return nil
-			})
-			elapsed := time.Since(start)
-			cacheDuration := elapsed * 20
-			if cacheDuration > 1*time.Minute {
-				cacheDuration = 1 * time.Minute
+/*
+what's in commits/ (prefix ""), commits/47/ (prefix "47") or commits/47/47e3/
+(prefix "47e3"). It's a copy, so it's safe to use after we let go of the lock
+*/
+func listCommits(repo *git.Repository, prefix string) []string {
+	getCommits(repo)
+	cachedCommitsLock.Lock()
+	defer cachedCommitsLock.Unlock()
+	var names []string
+	switch len(prefix) {
+	case 0:
+		for name := range cachedCommits.commits {
+			names = append(names, name)
+		}
+	case 2:
+		for name := range cachedCommits.commits[prefix] {
+			names = append(names, name)
+		}
+	case 4:
+		for name := range cachedCommits.commits[prefix[:2]][prefix] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func allCommits(repo *git.Repository) []plumbing.Hash {
+	getCommits(repo)
+	cachedCommitsLock.Lock()
+	defer cachedCommitsLock.Unlock()
+	var ids []plumbing.Hash
+	for _, prefixes := range cachedCommits.commits {
+		for _, prefix := range prefixes {
+			for id := range prefix {
+				ids = append(ids, plumbing.NewHash(id))
 			}
-			cachedCommits.expiry = time.Now().Add(cacheDuration)
-		} else {
-			log.Fatal("can't get loose objects")
 		}
 	}
-	return cachedCommits.commits, nil
+	return ids
 }
 
 func (f *CommitsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	commits, err := getCommits(f.repo)
-	if err != nil {
-		log.Printf("error: can't get commits: %v", err)
-		return nil, err
-	}
+	prefixes := listCommits(f.repo, "")
 	var entries []fuse.Dirent
-	for prefix := range commits {
+	for _, prefix := range prefixes {
 		entries = append(entries, fuse.Dirent{
 			Name: prefix,
 			Type: fuse.DT_Dir,
@@ -145,7 +211,10 @@ func (f *CommitsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 }
 
 func (f *CommitsDir) Lookup(ctx context.Context, prefix string) (fs.Node, error) {
-	return &CommitsPrefixDir{repo: f.repo, prefix: prefix}, nil
+	if len(prefix) != 2 {
+		return nil, fuse.ENOENT
+	}
+	return &CommitsPrefixDir{repo: f.repo, prefix: prefix, links: f.links}, nil
 }
 
 func (f *CommitsPrefixDir) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -155,13 +224,9 @@ func (f *CommitsPrefixDir) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 func (f *CommitsPrefixDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	commits, err := getCommits(f.repo)
-	if err != nil {
-		log.Printf("error: can't get commits: %v", err)
-		return nil, err
-	}
+	prefixes := listCommits(f.repo, f.prefix)
 	var entries []fuse.Dirent
-	for prefix := range commits[f.prefix] {
+	for _, prefix := range prefixes {
 		entries = append(entries, fuse.Dirent{
 			Name: prefix,
 			Type: fuse.DT_Dir,
@@ -171,7 +236,10 @@ func (f *CommitsPrefixDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error
 }
 
 func (f *CommitsPrefixDir) Lookup(ctx context.Context, prefix string) (fs.Node, error) {
-	return &CommitsPrefixDir2{repo: f.repo, prefix: prefix}, nil
+	if len(prefix) != 4 || !strings.HasPrefix(prefix, f.prefix) {
+		return nil, fuse.ENOENT
+	}
+	return &CommitsPrefixDir2{repo: f.repo, prefix: prefix, links: f.links}, nil
 }
 
 func (f *CommitsPrefixDir2) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -181,13 +249,9 @@ func (f *CommitsPrefixDir2) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 func (f *CommitsPrefixDir2) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	commits, err := getCommits(f.repo)
-	if err != nil {
-		log.Printf("error: can't get commits: %v", err)
-		return nil, err
-	}
+	commits := listCommits(f.repo, f.prefix)
 	entries := []fuse.Dirent{}
-	for commit := range commits[f.prefix[:2]][f.prefix] {
+	for _, commit := range commits {
 		entries = append(entries, fuse.Dirent{
 			Name: commit,
 			Type: fuse.DT_Dir,
@@ -196,6 +260,20 @@ func (f *CommitsPrefixDir2) ReadDirAll(ctx context.Context) ([]fuse.Dirent, erro
 	return entries, nil
 }
 
+/* the commits' attributes don't depend on the commit, so we don't need to read them */
+func (f *CommitsPrefixDir2) ReadDirAttrs(ctx context.Context) ([]fuse.Dirent, []fuse.Attr, error) {
+	dirents, err := f.ReadDirAll(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := make([]fuse.Attr, len(dirents))
+	for i, d := range dirents {
+		tree := &GitTree{path: "/commits/" + f.prefix[:2] + "/" + f.prefix + "/" + d.Name}
+		tree.Attr(ctx, &attrs[i])
+	}
+	return dirents, attrs, nil
+}
+
 func (f *CommitsPrefixDir2) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	/* get the git tree */
 	commit, err := f.repo.CommitObject(plumbing.NewHash(name))
@@ -203,60 +281,69 @@ func (f *CommitsPrefixDir2) Lookup(ctx context.Context, name string) (fs.Node, e
 		log.Printf("error: can't get commit object: %v", err)
 		return nil, fuse.ENOENT
 	}
-	return &GitTree{repo: f.repo, id: commit.TreeHash}, nil
+	return &GitTree{repo: f.repo, id: commit.TreeHash, path: "/commits/" + f.prefix[:2] + "/" + f.prefix + "/" + name, links: f.links}, nil
 }
 
 type GitTree struct {
 	repo *git.Repository
 	id   plumbing.Hash
+	/* where it is in the mount (the same tree can be in lots of places) */
+	path  string
+	links *blobLinks
 }
 
 type GitBlob struct {
-	repo *git.Repository
-	id   plumbing.Hash
-	mode filemode.FileMode
+	repo  *git.Repository
+	id    plumbing.Hash
+	mode  filemode.FileMode
+	path  string
+	links *blobLinks
 }
 
 func (t *GitTree) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0o555
-	a.Inode = inode(t.id.String())
+	a.Inode = inode(t.path)
 	return nil
 }
 
 func (t *GitTree) Lookup(ctx context.Context, name string) (fs.Node, error) {
-	tree, err := t.repo.TreeObject(t.id)
+	tree, err := getTree(t.repo, t.id)
 	if err != nil {
 		return nil, fmt.Errorf("lookup %s: %w", name, err)
 	}
+	entry, ok := tree.entry(name)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return t.node(entry)
+}
 
-	for _, entry := range tree.Entries {
-		if entry.Name == name {
-			switch entry.Mode {
-			case filemode.Dir:
-				return &GitTree{repo: t.repo, id: entry.Hash}, nil
-			case filemode.Regular:
-				return &GitBlob{repo: t.repo, id: entry.Hash, mode: entry.Mode}, nil
-			case filemode.Executable:
-				return &GitBlob{repo: t.repo, id: entry.Hash, mode: entry.Mode}, nil
-			case filemode.Symlink:
-				content, err := readBlob(t.repo, entry.Hash)
-				if err != nil {
-					return nil, fmt.Errorf("read symlink: %w", err)
-				}
-				return &SymLink{string(content)}, nil
-			case filemode.Submodule:
-				fmt.Printf("warning: submodule %s not supported\n", entry.Name)
-				return nil, fuse.ENOENT
-			default:
-				fmt.Printf("Unknown mode %s\n", entry.Mode)
-			}
+func (t *GitTree) node(entry object.TreeEntry) (fs.Node, error) {
+	p := t.path + "/" + entry.Name
+	switch entry.Mode {
+	case filemode.Dir:
+		return &GitTree{repo: t.repo, id: entry.Hash, path: p, links: t.links}, nil
+	case filemode.Regular:
+		return &GitBlob{repo: t.repo, id: entry.Hash, mode: entry.Mode, path: p, links: t.links}, nil
+	case filemode.Executable:
+		return &GitBlob{repo: t.repo, id: entry.Hash, mode: entry.Mode, path: p, links: t.links}, nil
+	case filemode.Symlink:
+		content, err := readBlob(t.repo, entry.Hash)
+		if err != nil {
+			return nil, fmt.Errorf("read symlink: %w", err)
 		}
+		return &SymLink{string(content), p}, nil
+	case filemode.Submodule:
+		fmt.Printf("warning: submodule %s not supported\n", entry.Name)
+		return nil, fuse.ENOENT
+	default:
+		fmt.Printf("Unknown mode %s\n", entry.Mode)
 	}
 	return nil, fuse.ENOENT
 }
 
 func (b *GitTree) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	tree, err := b.repo.TreeObject(b.id)
+	tree, err := getTree(b.repo, b.id)
 	if err != nil {
 		log.Printf("error: can't read tree object: %v", err)
 		return nil, err
@@ -286,8 +373,37 @@ func (b *GitTree) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	return dirs, nil
 }
 
+/*
+for the NFS & WebDAV adapters: everything in the directory and its attributes
+in one go, instead of a Lookup (which used to re-read the tree) + Attr for
+every single entry
+*/
+func (t *GitTree) ReadDirAttrs(ctx context.Context) ([]fuse.Dirent, []fuse.Attr, error) {
+	dirents, err := t.ReadDirAll(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := getTree(t.repo, t.id)
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := make([]fuse.Attr, len(dirents))
+	for i, d := range dirents {
+		entry, _ := tree.entry(d.Name)
+		node, err := t.node(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := node.Attr(ctx, &attrs[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+	return dirents, attrs, nil
+}
+
 func (b *GitBlob) Attr(ctx context.Context, a *fuse.Attr) error {
-	content, err := b.ReadAll(ctx)
+	/* we only need the size, so don't read the whole thing */
+	obj, err := b.repo.Storer.EncodedObject(plumbing.BlobObject, b.id)
 	if err != nil {
 		log.Printf("error: can't read git blob: %v", err)
 		return err
@@ -300,9 +416,14 @@ func (b *GitBlob) Attr(ctx context.Context, a *fuse.Attr) error {
 	default:
 		a.Mode = 0o444
 	}
-	a.Size = uint64(len(content))
+	a.Size = uint64(obj.Size())
 	a.Mtime = time.Unix(0, 0)
 	a.Ctime = time.Unix(0, 0)
+	a.Inode = inode(b.path)
+	if b.links != nil {
+		a.Inode = objectInode(b.id)
+		a.Nlink = b.links.count(b.id)
+	}
 	return nil
 }
 
@@ -323,6 +444,15 @@ func (b *GitBlob) ReadAll(ctx context.Context) ([]byte, error) {
 	return readBlob(b.repo, b.id)
 }
 
+/* the WebDAV adapter uses these for ETags */
+func (t *GitTree) ObjectID() plumbing.Hash {
+	return t.id
+}
+
+func (b *GitBlob) ObjectID() plumbing.Hash {
+	return b.id
+}
+
 func commitPath(id string) string {
 	return "commits/" + id[:2] + "/" + id[:4] + "/" + id
 }
@@ -0,0 +1,237 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  file_log/<rev>/<path>/ has every version of <path>, newest first:
+
+  file_log/main/fuse/commit.go/00-<hash>.go
+  file_log/main/fuse/commit.go/01-<hash>.go
+
+  where <hash> is the commit that introduced that version of the file.
+  Directories in <rev> show up as directories, and so do files (that's
+  where the versions go).
+*/
+
+type FileLogDir struct {
+	repo *git.Repository
+}
+
+type FileLogTree struct {
+	repo   *git.Repository
+	commit plumbing.Hash
+	path   string
+	id     plumbing.Hash
+}
+
+type FileVersionsDir struct {
+	repo   *git.Repository
+	commit plumbing.Hash
+	path   string
+}
+
+type fileVersion struct {
+	commit plumbing.Hash
+	blob   plumbing.Hash
+	mode   filemode.FileMode
+}
+
+func (f *FileLogDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/file_log")
+	return nil
+}
+
+func (f *FileLogDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	/* any revision works here, but we only list the branches */
+	var entries []fuse.Dirent
+	branches, err := f.repo.Branches()
+	if err != nil {
+		return nil, err
+	}
+	branches.ForEach(func(branch *plumbing.Reference) error {
+		entries = append(entries, fuse.Dirent{
+			Name: branch.Name().Short(),
+			Type: fuse.DT_Dir,
+		})
+		return nil
+	})
+	return entries, nil
+}
+
+func (f *FileLogDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	hash, err := f.repo.ResolveRevision(plumbing.Revision(name))
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	commit, err := f.repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &FileLogTree{repo: f.repo, commit: commit.Hash, path: "", id: commit.TreeHash}, nil
+}
+
+func (t *FileLogTree) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/file_log/" + t.commit.String() + "/" + t.path)
+	return nil
+}
+
+func (t *FileLogTree) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	tree, err := getTree(t.repo, t.id)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for _, entry := range tree.Entries {
+		switch entry.Mode {
+		case filemode.Dir, filemode.Regular, filemode.Executable:
+			entries = append(entries, fuse.Dirent{Name: entry.Name, Type: fuse.DT_Dir})
+		}
+	}
+	return entries, nil
+}
+
+func (t *FileLogTree) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	tree, err := getTree(t.repo, t.id)
+	if err != nil {
+		return nil, fmt.Errorf("lookup %s: %w", name, err)
+	}
+	if entry, ok := tree.entry(name); ok {
+		switch entry.Mode {
+		case filemode.Dir:
+			return &FileLogTree{repo: t.repo, commit: t.commit, path: path.Join(t.path, name), id: entry.Hash}, nil
+		case filemode.Regular, filemode.Executable:
+			return &FileVersionsDir{repo: t.repo, commit: t.commit, path: path.Join(t.path, name)}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *FileVersionsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/file_log/" + d.commit.String() + "/" + d.path)
+	return nil
+}
+
+func (d *FileVersionsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	versions, err := fileVersions(d.repo, d.commit, d.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for i, version := range versions {
+		entries = append(entries, fuse.Dirent{
+			Name: fmt.Sprintf("%02d-%s%s", i, version.commit.String(), path.Ext(d.path)),
+			Type: fuse.DT_File,
+		})
+	}
+	return entries, nil
+}
+
+func (d *FileVersionsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	_, hash, ok := strings.Cut(strings.TrimSuffix(name, path.Ext(d.path)), "-")
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	versions, err := fileVersions(d.repo, d.commit, d.path)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		if version.commit.String() == hash {
+			return &GitBlob{repo: d.repo, id: version.blob, mode: version.mode, path: "/file_log/" + d.commit.String() + "/" + d.path + "/" + name}, nil
+		}
+	}
+	return nil, fuse.ENOENT
+}
+
+/* the history of a file at a commit never changes, so we cache it (until there's too much) */
+var fileVersionsCache = make(map[string][]fileVersion)
+var fileVersionsCacheLock sync.Mutex
+
+/*
+Walk the first-parent history starting at `start` and keep one entry for
+each distinct blob, attributed to the oldest commit that had it (the one
+that introduced it). When the file doesn't exist in the parent we check if
+it was renamed and keep following the old name.
+*/
+func fileVersions(repo *git.Repository, start plumbing.Hash, filename string) ([]fileVersion, error) {
+	key := start.String() + ":" + filename
+	fileVersionsCacheLock.Lock()
+	versions, ok := fileVersionsCache[key]
+	fileVersionsCacheLock.Unlock()
+	if ok {
+		return versions, nil
+	}
+
+	commit, err := repo.CommitObject(start)
+	if err != nil {
+		return nil, err
+	}
+	for commit != nil {
+		file, err := commit.File(filename)
+		if err != nil {
+			break
+		}
+		if len(versions) > 0 && versions[len(versions)-1].blob == file.Hash {
+			versions[len(versions)-1].commit = commit.Hash
+		} else {
+			versions = append(versions, fileVersion{commit: commit.Hash, blob: file.Hash, mode: file.Mode})
+		}
+
+		if commit.NumParents() == 0 {
+			break
+		}
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := parent.File(filename); err == object.ErrFileNotFound {
+			filename, err = renamedFrom(commit, filename)
+			if err != nil {
+				return nil, err
+			}
+			if filename == "" {
+				break
+			}
+		}
+		commit = parent
+	}
+
+	fileVersionsCacheLock.Lock()
+	if len(fileVersionsCache) > 1000 {
+		fileVersionsCache = make(map[string][]fileVersion)
+	}
+	fileVersionsCache[key] = versions
+	fileVersionsCacheLock.Unlock()
+	return versions, nil
+}
+
+/* returns "" if filename was added in commit instead of being renamed */
+func renamedFrom(commit *object.Commit, filename string) (string, error) {
+	changes, err := commitChanges(commit)
+	if err != nil {
+		return "", err
+	}
+	for _, change := range changes {
+		if change.To.Name == filename && change.From.Name != "" {
+			return change.From.Name, nil
+		}
+	}
+	return "", nil
+}
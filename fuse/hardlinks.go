@@ -0,0 +1,157 @@
+package fuse
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+/*
+  -hardlink-blobs: the same file in 100 commits is really just 1 blob, so
+  in commits/ we give every copy of it the same inode (the blob's id) and set
+  Nlink to the number of copies. That way `du -sh commits/` and backup tools
+  count it once, like they would for real hardlinks.
+
+  Counting the copies means looking at every tree of every commit, but each
+  tree only gets read once: if a tree shows up N times, everything in it
+  shows up N times too.
+*/
+
+type blobLinks struct {
+	repo *git.Repository
+	lock sync.Mutex
+	/* blob -> how many times it's in commits/ */
+	counts map[plumbing.Hash]uint32
+	/* the commits that are in `counts` */
+	counted  map[plumbing.Hash]bool
+	expiry   time.Time
+	counting bool
+}
+
+func newBlobLinks(repo *git.Repository) *blobLinks {
+	return &blobLinks{repo: repo, counts: make(map[plumbing.Hash]uint32), counted: make(map[plumbing.Hash]bool)}
+}
+
+func objectInode(id plumbing.Hash) uint64 {
+	return hashInode("object", id.String())
+}
+
+/*
+Nlink for a blob in commits/. Counting happens in the background, so until
+it's done (or for commits it hasn't got to yet) it's 1
+*/
+func (l *blobLinks) count(id plumbing.Hash) uint32 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !l.counting && l.expiry.Before(time.Now()) {
+		l.counting = true
+		go l.refresh()
+	}
+	if n := l.counts[id]; n > 0 {
+		return n
+	}
+	return 1
+}
+
+/*
+count the blobs in commits we haven't counted yet (at most once a minute, it's
+slow). A blob's count is just the sum over every commit, so new commits get
+added to the old counts instead of starting over
+*/
+func (l *blobLinks) refresh() {
+	all := allCommits(l.repo)
+	var ids []plumbing.Hash
+	l.lock.Lock()
+	for _, id := range all {
+		if !l.counted[id] {
+			ids = append(ids, id)
+		}
+	}
+	l.lock.Unlock()
+
+	start := time.Now()
+	counts, err := countBlobs(l.repo, ids)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.counting = false
+	l.expiry = time.Now().Add(time.Minute)
+	if err != nil {
+		log.Printf("error: can't count blobs: %v", err)
+		return
+	}
+	for id, n := range counts {
+		l.counts[id] += n
+	}
+	for _, id := range ids {
+		l.counted[id] = true
+	}
+	if len(ids) > 0 {
+		log.Printf("counted blobs in %d commits in %s", len(ids), time.Since(start))
+	}
+}
+
+func countBlobs(repo *git.Repository, commitIDs []plumbing.Hash) (map[plumbing.Hash]uint32, error) {
+	treeCounts := make(map[plumbing.Hash]uint32)
+	for _, id := range commitIDs {
+		commit, err := repo.CommitObject(id)
+		if err != nil {
+			return nil, err
+		}
+		treeCounts[commit.TreeHash]++
+	}
+
+	/*
+	  Put the trees in an order where every tree comes before all of its
+	  subtrees (reverse postorder), then push the counts down.
+	*/
+	var order []plumbing.Hash
+	visited := make(map[plumbing.Hash]bool)
+	var visit func(id plumbing.Hash) error
+	visit = func(id plumbing.Hash) error {
+		if visited[id] {
+			return nil
+		}
+		visited[id] = true
+		tree, err := repo.TreeObject(id)
+		if err != nil {
+			return err
+		}
+		for _, entry := range tree.Entries {
+			if entry.Mode == filemode.Dir {
+				if err := visit(entry.Hash); err != nil {
+					return err
+				}
+			}
+		}
+		order = append(order, id)
+		return nil
+	}
+	for id := range treeCounts {
+		if err := visit(id); err != nil {
+			return nil, err
+		}
+	}
+
+	blobCounts := make(map[plumbing.Hash]uint32)
+	for i := len(order) - 1; i >= 0; i-- {
+		id := order[i]
+		tree, err := repo.TreeObject(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range tree.Entries {
+			switch entry.Mode {
+			case filemode.Dir:
+				treeCounts[entry.Hash] += treeCounts[id]
+			case filemode.Regular, filemode.Executable:
+				blobCounts[entry.Hash] += treeCounts[id]
+			}
+		}
+	}
+	return blobCounts, nil
+}
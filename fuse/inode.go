@@ -2,10 +2,32 @@ package fuse
 
 import "hash/fnv"
 
-/* generate inode by hashing filename */
+/*
+  Inode numbers.
 
-func inode(filename string) uint64 {
+  Everything gets its inode by hashing its path in the mount (like
+  "/commits/ab/abcd/<hash>/README.md"), NOT by hashing what's in it. Otherwise
+  the same tree showing up in 2 commits looks like a hardlinked directory and
+  `find` and `du` get confused. Hashing means they're the same every time you
+  mount, and FUSE, NFS and WebDAV all just use whatever Attr says.
+
+  The "kind" goes into the hash too so that an inode for a path can never be
+  the same as an inode for some other kind of key.
+*/
+
+func inode(path string) uint64 {
+	return hashInode("path", path)
+}
+
+func hashInode(kind string, key string) uint64 {
 	h := fnv.New64a()
-	h.Write([]byte(filename))
-	return h.Sum64()
+	h.Write([]byte(kind))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	n := h.Sum64()
+	/* 0 means "no inode" and 1 is the root */
+	if n <= 1 {
+		n += 2
+	}
+	return n
 }
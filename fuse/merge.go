@@ -0,0 +1,328 @@
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+/*
+  Just enough of a 3-way merge to do cherry-picks and reverts: we take the
+  changes between `base` and `theirs` and apply them on top of `ours`. Files
+  that changed on both sides get merged line by line, and if the changes
+  overlap that's a conflict and we give up (there's nowhere to put conflict
+  markers).
+*/
+
+type ConflictError struct {
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	return "conflicts in: " + strings.Join(e.Paths, ", ")
+}
+
+/* creates a new commit on top of `onto` with the changes from `commit` */
+func cherryPick(repo *git.Repository, onto *object.Commit, commit *object.Commit) (plumbing.Hash, error) {
+	if commit.NumParents() != 1 {
+		return plumbing.ZeroHash, fmt.Errorf("can only cherry-pick commits with exactly one parent, %s has %d", commit.Hash, commit.NumParents())
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tree, err := mergeTrees(repo, parent.TreeHash, onto.TreeHash, commit.TreeHash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	committer, err := signature(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	/* like `git cherry-pick -x` */
+	message := strings.TrimRight(commit.Message, "\n") + fmt.Sprintf("\n\n(cherry picked from commit %s)\n", commit.Hash)
+	return writeCommit(repo, &object.Commit{
+		Author:       commit.Author,
+		Committer:    committer,
+		Message:      message,
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{onto.Hash},
+	})
+}
+
+/* creates a new commit on top of `onto` that undoes `commit` */
+func revert(repo *git.Repository, onto *object.Commit, commit *object.Commit) (plumbing.Hash, error) {
+	if commit.NumParents() != 1 {
+		return plumbing.ZeroHash, fmt.Errorf("can only revert commits with exactly one parent, %s has %d", commit.Hash, commit.NumParents())
+	}
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tree, err := mergeTrees(repo, commit.TreeHash, onto.TreeHash, parent.TreeHash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	sig, err := signature(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	subject := strings.SplitN(commit.Message, "\n", 2)[0]
+	return writeCommit(repo, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.\n", subject, commit.Hash),
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{onto.Hash},
+	})
+}
+
+func writeCommit(repo *git.Repository, commit *object.Commit) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+func mergeTrees(repo *git.Repository, baseID, oursID, theirsID plumbing.Hash) (plumbing.Hash, error) {
+	base, err := repo.TreeObject(baseID)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	theirs, err := repo.TreeObject(theirsID)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ours, err := repo.TreeObject(oursID)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	files, err := flattenTree(ours)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	changes, err := object.DiffTree(base, theirs)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var conflicts []string
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		before, after := change.From.TreeEntry, change.To.TreeEntry
+		current, exists := files[name]
+		switch {
+		case sameEntry(current, exists, before, change.From.Name != ""):
+			/* we didn't touch this file, so just take their version */
+			if change.To.Name == "" {
+				delete(files, name)
+			} else {
+				files[name] = after
+			}
+		case sameEntry(current, exists, after, change.To.Name != ""):
+			/* we already have their version */
+		case exists && change.From.Name != "" && change.To.Name != "" && current.Mode == after.Mode:
+			merged, ok, err := mergeBlobs(repo, before.Hash, current.Hash, after.Hash)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			if !ok {
+				conflicts = append(conflicts, name)
+				continue
+			}
+			hash, err := writeBlob(repo, merged)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			files[name] = object.TreeEntry{Name: current.Name, Mode: current.Mode, Hash: hash}
+		default:
+			conflicts = append(conflicts, name)
+		}
+	}
+	if len(conflicts) > 0 {
+		return plumbing.ZeroHash, &ConflictError{Paths: conflicts}
+	}
+	return writeFlatTree(repo, files)
+}
+
+func sameEntry(a object.TreeEntry, aExists bool, b object.TreeEntry, bExists bool) bool {
+	if !aExists || !bExists {
+		return aExists == bExists
+	}
+	return a.Hash == b.Hash && a.Mode == b.Mode
+}
+
+/* every file in the tree (not directories), by full path */
+func flattenTree(tree *object.Tree) (map[string]object.TreeEntry, error) {
+	files := make(map[string]object.TreeEntry)
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.Mode != filemode.Dir {
+			files[name] = entry
+		}
+	}
+	return files, nil
+}
+
+/* the opposite of flattenTree: writes all the tree objects, returns the root */
+func writeFlatTree(repo *git.Repository, files map[string]object.TreeEntry) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	subdirs := make(map[string]map[string]object.TreeEntry)
+	for name, entry := range files {
+		dir, rest, ok := strings.Cut(name, "/")
+		if !ok {
+			entry.Name = name
+			tree.Entries = append(tree.Entries, entry)
+			continue
+		}
+		if subdirs[dir] == nil {
+			subdirs[dir] = make(map[string]object.TreeEntry)
+		}
+		subdirs[dir][rest] = entry
+	}
+	for dir, subfiles := range subdirs {
+		hash, err := writeFlatTree(repo, subfiles)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+	sortTreeEntries(tree.Entries)
+	obj := repo.Storer.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+/* returns false if there's a conflict */
+func mergeBlobs(repo *git.Repository, baseID, oursID, theirsID plumbing.Hash) ([]byte, bool, error) {
+	var contents [3][]byte
+	for i, id := range []plumbing.Hash{baseID, oursID, theirsID} {
+		content, err := readBlob(repo, id)
+		if err != nil {
+			return nil, false, err
+		}
+		/* don't try to merge binary files */
+		if bytes.IndexByte(content, 0) >= 0 {
+			return nil, false, nil
+		}
+		contents[i] = content
+	}
+	merged, ok := merge3(string(contents[0]), string(contents[1]), string(contents[2]))
+	return merged, ok, nil
+}
+
+/* replace lines [start, end) of the original with `lines` */
+type hunk struct {
+	start, end int
+	lines      []string
+}
+
+func merge3(base, ours, theirs string) ([]byte, bool) {
+	ourHunks := lineHunks(base, ours)
+	theirHunks := lineHunks(base, theirs)
+
+	all := ourHunks
+	for _, t := range theirHunks {
+		duplicate := false
+		for _, o := range ourHunks {
+			if o.start == t.start && o.end == t.end && strings.Join(o.lines, "") == strings.Join(t.lines, "") {
+				duplicate = true
+				break
+			}
+			/* touching counts as overlapping, like in git */
+			if o.start <= t.end && t.start <= o.end {
+				return nil, false
+			}
+		}
+		if !duplicate {
+			all = append(all, t)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+
+	baseLines := splitLines(base)
+	var out strings.Builder
+	pos := 0
+	for _, h := range all {
+		out.WriteString(strings.Join(baseLines[pos:h.start], ""))
+		out.WriteString(strings.Join(h.lines, ""))
+		pos = h.end
+	}
+	out.WriteString(strings.Join(baseLines[pos:], ""))
+	return []byte(out.String()), true
+}
+
+func lineHunks(from, to string) []hunk {
+	var hunks []hunk
+	var current *hunk
+	pos := 0
+	for _, d := range diff.Do(from, to) {
+		lines := splitLines(d.Text)
+		if d.Type == diffmatchpatch.DiffEqual {
+			if current != nil {
+				hunks = append(hunks, *current)
+				current = nil
+			}
+			pos += len(lines)
+			continue
+		}
+		if current == nil {
+			current = &hunk{start: pos, end: pos}
+		}
+		if d.Type == diffmatchpatch.DiffDelete {
+			current.end += len(lines)
+			pos += len(lines)
+		} else {
+			current.lines = append(current.lines, lines...)
+		}
+	}
+	if current != nil {
+		hunks = append(hunks, *current)
+	}
+	return hunks
+}
+
+/* like strings.Split but keeps the newlines */
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+/* `git merge-base --is-ancestor` */
+func isAncestor(repo *git.Repository, ancestor, descendant plumbing.Hash) (bool, error) {
+	a, err := repo.CommitObject(ancestor)
+	if err != nil {
+		return false, err
+	}
+	d, err := repo.CommitObject(descendant)
+	if err != nil {
+		return false, err
+	}
+	return a.IsAncestor(d)
+}
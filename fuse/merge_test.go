@@ -0,0 +1,45 @@
+package fuse
+
+import "testing"
+
+func TestMerge3(t *testing.T) {
+	base := "a\nb\nc\nd\ne\n"
+	tests := []struct {
+		name         string
+		ours, theirs string
+		want         string
+		ok           bool
+	}{
+		{"nothing changed", base, base, base, true},
+		{"only ours", "a\nB\nc\nd\ne\n", base, "a\nB\nc\nd\ne\n", true},
+		{"only theirs", base, "a\nb\nc\nD\ne\n", "a\nb\nc\nD\ne\n", true},
+		{"both, far apart", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		{"the same change", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", "a\nB\nc\nd\ne\n", true},
+		{"insert and delete", "a\nb\nnew\nc\nd\ne\n", "a\nb\nc\nd\n", "a\nb\nnew\nc\nd\n", true},
+		{"same line", "a\nB\nc\nd\ne\n", "a\nX\nc\nd\ne\n", "", false},
+		/* like git, changes to lines next to each other conflict */
+		{"touching", "a\nB\nc\nd\ne\n", "a\nb\nC\nd\ne\n", "", false},
+		{"no newline at the end", "a\nb\nc\nd\ne", base, "a\nb\nc\nd\ne", true},
+	}
+	for _, test := range tests {
+		got, ok := merge3(base, test.ours, test.theirs)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if ok && string(got) != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestMerge3Empty(t *testing.T) {
+	got, ok := merge3("", "a\n", "")
+	if !ok || string(got) != "a\n" {
+		t.Errorf("got %q, %v", got, ok)
+	}
+	/* both sides adding different files from nothing */
+	if _, ok := merge3("", "a\n", "b\n"); ok {
+		t.Errorf("expected a conflict")
+	}
+}
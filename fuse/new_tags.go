@@ -0,0 +1,267 @@
+package fuse
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  tags/.new/ is how you make annotated tags (only with -writable-refs):
+
+  $ echo "release 1.2.3" > tags/.new/v1.2.3/message
+  $ ln -s ../../../commits/ab/abcd/<hash> tags/.new/v1.2.3/target
+
+  The message only lives in memory until the symlink gets created, then the
+  tag object and refs/tags/v1.2.3 get written and tags/.new/v1.2.3 goes away.
+*/
+
+type NewTagsDir struct {
+	repo  *git.Repository
+	refs  *refWriter
+	force bool
+}
+
+type NewTagDir struct {
+	repo  *git.Repository
+	refs  *refWriter
+	force bool
+	name  string
+}
+
+type TagMessageFile struct {
+	refs *refWriter
+	name string
+}
+
+func (d *NewTagsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o755
+	a.Inode = inode("/tags/.new")
+	return nil
+}
+
+func (d *NewTagsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	for _, name := range d.refs.pendingTags() {
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	return entries, nil
+}
+
+/* every name exists so that you don't need to mkdir before writing the message */
+func (d *NewTagsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	return &NewTagDir{repo: d.repo, refs: d.refs, force: d.force, name: name}, nil
+}
+
+func (d *NewTagDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o755
+	a.Inode = inode("/tags/.new/" + d.name)
+	return nil
+}
+
+func (d *NewTagDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	if _, ok := d.refs.tagMessage(d.name); !ok {
+		return []fuse.Dirent{}, nil
+	}
+	return []fuse.Dirent{{Name: "message", Type: fuse.DT_File}}, nil
+}
+
+func (d *NewTagDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if _, ok := d.refs.tagMessage(d.name); name != "message" || !ok {
+		return nil, fuse.ENOENT
+	}
+	return &TagMessageFile{refs: d.refs, name: d.name}, nil
+}
+
+func (d *NewTagDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if req.Name != "message" {
+		return nil, nil, fuse.EPERM
+	}
+	if err := checkRefName(plumbing.NewTagReferenceName(d.name)); err != nil {
+		return nil, nil, err
+	}
+	d.refs.setTagMessage(d.name, []byte{})
+	f := &TagMessageFile{refs: d.refs, name: d.name}
+	return f, f, nil
+}
+
+func (d *NewTagDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if req.NewName != "target" {
+		return nil, fuse.EPERM
+	}
+	hash, err := commitFromLinkTarget(d.repo, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	message, ok := d.refs.tagMessage(d.name)
+	if !ok || len(message) == 0 {
+		log.Printf("can't create tag %s: write a message to tags/.new/%s/message first", d.name, d.name)
+		return nil, fuse.Errno(syscall.EINVAL)
+	}
+	if err := d.refs.createAnnotatedTag(d.name, hash, string(message), d.force); err != nil {
+		return nil, err
+	}
+	return &SymLink{req.Target, "/tags/.new/" + d.name + "/target"}, nil
+}
+
+func (f *TagMessageFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	message, _ := f.refs.tagMessage(f.name)
+	a.Mode = 0o644
+	a.Size = uint64(len(message))
+	a.Inode = inode("/tags/.new/" + f.name + "/message")
+	return nil
+}
+
+func (f *TagMessageFile) ReadAll(ctx context.Context) ([]byte, error) {
+	message, _ := f.refs.tagMessage(f.name)
+	return message, nil
+}
+
+func (f *TagMessageFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	if err := f.refs.writeTagMessage(f.name, req.Offset, req.Data); err != nil {
+		return err
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
+
+/* this is how `echo > message` truncates the file */
+func (f *TagMessageFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		return f.refs.truncateTagMessage(f.name, req.Size)
+	}
+	return nil
+}
+
+/* tag messages live in memory, so they can't be huge */
+const maxTagMessage = 1 << 20
+
+func (w *refWriter) writeTagMessage(name string, offset int64, data []byte) error {
+	if offset < 0 || offset > maxTagMessage || int64(len(data)) > maxTagMessage-offset {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	message, ok := w.tagMessages[name]
+	if !ok {
+		/* the tag got created while the file was open */
+		return fuse.ENOENT
+	}
+	w.tagMessages[name] = writeAt(message, offset, data)
+	return nil
+}
+
+func (w *refWriter) truncateTagMessage(name string, size uint64) error {
+	if size > maxTagMessage {
+		return fuse.Errno(syscall.EFBIG)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	message, ok := w.tagMessages[name]
+	if !ok {
+		return fuse.ENOENT
+	}
+	w.tagMessages[name] = truncate(message, size)
+	return nil
+}
+
+func (w *refWriter) pendingTags() []string {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var names []string
+	for name := range w.tagMessages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (w *refWriter) tagMessage(name string) ([]byte, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	message, ok := w.tagMessages[name]
+	/* copy it so that nobody else's writes show up in it */
+	return append([]byte{}, message...), ok
+}
+
+func (w *refWriter) setTagMessage(name string, message []byte) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.tagMessages[name] = message
+}
+
+/*
+the tag object gets made before we touch the ref, so that if that fails (like
+when there's no user.name in the git config) a tag we're replacing with
+-force-tags is still there
+*/
+func (w *refWriter) createAnnotatedTag(name string, hash plumbing.Hash, message string, force bool) error {
+	refName := plumbing.NewTagReferenceName(name)
+	if err := checkRefName(refName); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var old *plumbing.Reference
+	if _, err := w.repo.Storer.Reference(refName); err == nil {
+		if !force {
+			return fuse.EEXIST
+		}
+		if old, err = w.checkUnchanged(refName); err != nil {
+			return err
+		}
+	}
+	id, err := newTagObject(w.repo, name, hash, message)
+	if err != nil {
+		return err
+	}
+	ref := plumbing.NewHashReference(refName, id)
+	if old == nil {
+		err = w.repo.Storer.SetReference(ref)
+	} else {
+		err = w.repo.Storer.CheckAndSetReference(ref, old)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("created annotated tag %s at %s", name, hash)
+	w.seen[refName] = id
+	delete(w.tagMessages, name)
+	return nil
+}
+
+/* what `repo.CreateTag` does, without also creating the ref */
+func newTagObject(repo *git.Repository, name string, hash plumbing.Hash, message string) (plumbing.Hash, error) {
+	tagger, err := signature(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	opts := &git.CreateTagOptions{Tagger: &tagger, Message: message}
+	if err := opts.Validate(repo, hash); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	target, err := object.GetObject(repo.Storer, hash)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tag := &object.Tag{
+		Name:       name,
+		Tagger:     *opts.Tagger,
+		Message:    opts.Message,
+		TargetType: target.Type(),
+		Target:     hash,
+	}
+	obj := repo.Storer.NewEncodedObject()
+	if err := tag.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
@@ -0,0 +1,53 @@
+package fuse
+
+import (
+	"context"
+	"math"
+	"syscall"
+	"testing"
+
+	"github.com/anacrolix/fuse"
+)
+
+func TestTagMessage(t *testing.T) {
+	repo, _ := testRepo(t, map[string]string{"a.txt": "a\n"})
+	refs := newRefWriter(repo)
+	dir := &NewTagDir{repo: repo, refs: refs, name: "v1"}
+	ctx := context.Background()
+	_, handle, err := dir.Create(ctx, &fuse.CreateRequest{Name: "message"}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := handle.(*TagMessageFile)
+	write := func(offset int64, data string) error {
+		return f.Write(ctx, &fuse.WriteRequest{Offset: offset, Data: []byte(data)}, &fuse.WriteResponse{})
+	}
+	if err := write(0, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(3, "p!\n"); err != nil {
+		t.Fatal(err)
+	}
+	if message, _ := refs.tagMessage("v1"); string(message) != "help!\n" {
+		t.Errorf("message %q", message)
+	}
+	for _, offset := range []int64{maxTagMessage, math.MaxInt64 - 1, -1} {
+		if err := write(offset, "x"); err != fuse.Errno(syscall.EFBIG) {
+			t.Errorf("write at %d: %v", offset, err)
+		}
+	}
+	if err := f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: math.MaxUint64}, &fuse.SetattrResponse{}); err != fuse.Errno(syscall.EFBIG) {
+		t.Errorf("truncate: %v", err)
+	}
+	if err := f.Setattr(ctx, &fuse.SetattrRequest{Valid: fuse.SetattrSize, Size: 4}, &fuse.SetattrResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if message, _ := refs.tagMessage("v1"); string(message) != "help" {
+		t.Errorf("message %q after truncating", message)
+	}
+
+	bad := &NewTagDir{repo: repo, refs: refs, name: "v1.lock"}
+	if _, _, err := bad.Create(ctx, &fuse.CreateRequest{Name: "message"}, &fuse.CreateResponse{}); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("message for a bad tag name: %v", err)
+	}
+}
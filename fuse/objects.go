@@ -0,0 +1,302 @@
+package fuse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+/*
+  objects/ has every object in the repo, split by prefix the same way as
+  commits/: objects/ab/abcd/<hash>
+
+  * blobs are files
+  * trees are directories
+  * tags are text files (the tag object itself)
+  * commits are symlinks into commits/
+
+  and every object also has two text versions next to it:
+
+  * <hash>.raw is the object exactly how git stores it (after zlib decompression),
+    with the "<type> <size>\0" header
+  * <hash>.txt is the pretty printed version, like `git cat-file -p`
+*/
+
+type ObjectsDir struct {
+	repo *git.Repository
+}
+
+type ObjectsPrefixDir struct {
+	/* /objects/af */
+	repo   *git.Repository
+	prefix string
+}
+
+type ObjectsPrefixDir2 struct {
+	/* /objects/af/afee */
+	repo   *git.Repository
+	prefix string
+}
+
+/* like CommitsCache, but we also need to remember each object's type for ReadDirAll */
+type ObjectsCache struct {
+	objects map[string]map[string]map[string]plumbing.ObjectType
+	expiry  time.Time
+}
+
+var cachedObjects *ObjectsCache
+var cachedObjectsLock sync.Mutex
+
+/*
+There are usually a lot more objects than commits, so unlike the commits we
+don't read them all at startup, only the first time someone lists objects/.
+After that we reread everything once the cache expires.
+*/
+func getObjects(repo *git.Repository) (map[string]map[string]map[string]plumbing.ObjectType, error) {
+	cachedObjectsLock.Lock()
+	defer cachedObjectsLock.Unlock()
+	if cachedObjects != nil && cachedObjects.expiry.After(time.Now()) {
+		return cachedObjects.objects, nil
+	}
+	start := time.Now()
+	iter, err := repo.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]map[string]map[string]plumbing.ObjectType)
+	err = iter.ForEach(func(obj plumbing.EncodedObject) error {
+		id := obj.Hash().String()
+		prefix1 := id[:2]
+		prefix2 := id[:4]
+		if _, ok := objects[prefix1]; !ok {
+			objects[prefix1] = make(map[string]map[string]plumbing.ObjectType)
+		}
+		if _, ok := objects[prefix1][prefix2]; !ok {
+			objects[prefix1][prefix2] = make(map[string]plumbing.ObjectType)
+		}
+		objects[prefix1][prefix2][id] = obj.Type()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	cacheDuration := time.Since(start) * 20
+	if cacheDuration > 1*time.Minute {
+		cacheDuration = 1 * time.Minute
+	}
+	cachedObjects = &ObjectsCache{objects: objects, expiry: time.Now().Add(cacheDuration)}
+	return objects, nil
+}
+
+func (f *ObjectsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Mtime = time.Unix(0, 0)
+	a.Ctime = time.Unix(0, 0)
+	a.Inode = inode("/objects")
+	return nil
+}
+
+func (f *ObjectsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	objects, err := getObjects(f.repo)
+	if err != nil {
+		log.Printf("error: can't get objects: %v", err)
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for prefix := range objects {
+		entries = append(entries, fuse.Dirent{
+			Name: prefix,
+			Type: fuse.DT_Dir,
+		})
+	}
+	return entries, nil
+}
+
+/*
+the lookups don't look at the object list at all (that would mean reading
+every object in the repo), they just check that the names look like the
+right prefix and leave it to the last one to find the object
+*/
+func (f *ObjectsDir) Lookup(ctx context.Context, prefix string) (fs.Node, error) {
+	if len(prefix) != 2 || !isHex(prefix) {
+		return nil, fuse.ENOENT
+	}
+	return &ObjectsPrefixDir{repo: f.repo, prefix: prefix}, nil
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *ObjectsPrefixDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/objects/" + f.prefix)
+	return nil
+}
+
+func (f *ObjectsPrefixDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	objects, err := getObjects(f.repo)
+	if err != nil {
+		log.Printf("error: can't get objects: %v", err)
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for prefix := range objects[f.prefix] {
+		entries = append(entries, fuse.Dirent{
+			Name: prefix,
+			Type: fuse.DT_Dir,
+		})
+	}
+	return entries, nil
+}
+
+func (f *ObjectsPrefixDir) Lookup(ctx context.Context, prefix string) (fs.Node, error) {
+	if len(prefix) != 4 || !strings.HasPrefix(prefix, f.prefix) || !isHex(prefix) {
+		return nil, fuse.ENOENT
+	}
+	return &ObjectsPrefixDir2{repo: f.repo, prefix: prefix}, nil
+}
+
+func (f *ObjectsPrefixDir2) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/objects/" + f.prefix[:2] + "/" + f.prefix)
+	return nil
+}
+
+func (f *ObjectsPrefixDir2) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	objects, err := getObjects(f.repo)
+	if err != nil {
+		log.Printf("error: can't get objects: %v", err)
+		return nil, err
+	}
+	entries := []fuse.Dirent{}
+	for id, typ := range objects[f.prefix[:2]][f.prefix] {
+		var d fuse.Dirent
+		switch typ {
+		case plumbing.TreeObject:
+			d.Type = fuse.DT_Dir
+		case plumbing.CommitObject:
+			d.Type = fuse.DT_Link
+		default:
+			d.Type = fuse.DT_File
+		}
+		d.Name = id
+		entries = append(entries, d)
+		entries = append(entries, fuse.Dirent{Name: id + ".raw", Type: fuse.DT_File})
+		entries = append(entries, fuse.Dirent{Name: id + ".txt", Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+func (f *ObjectsPrefixDir2) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	ext := path.Ext(name)
+	id := strings.TrimSuffix(name, ext)
+	if !plumbing.IsHash(id) || !strings.HasPrefix(id, f.prefix) {
+		return nil, fuse.ENOENT
+	}
+	obj, err := f.repo.Storer.EncodedObject(plumbing.AnyObject, plumbing.NewHash(id))
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	p := "/objects/" + f.prefix[:2] + "/" + f.prefix + "/" + name
+	switch ext {
+	case "":
+		return objectNode(f.repo, obj, p)
+	case ".raw":
+		content, err := rawObject(obj)
+		if err != nil {
+			return nil, err
+		}
+		return &TextFile{content: content, path: p}, nil
+	case ".txt":
+		content, err := prettyObject(f.repo, obj)
+		if err != nil {
+			return nil, err
+		}
+		return &TextFile{content: content, path: p}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func objectNode(repo *git.Repository, obj plumbing.EncodedObject, p string) (fs.Node, error) {
+	switch obj.Type() {
+	case plumbing.BlobObject:
+		return &GitBlob{repo: repo, id: obj.Hash(), mode: filemode.Regular, path: p}, nil
+	case plumbing.TreeObject:
+		return &GitTree{repo: repo, id: obj.Hash(), path: p}, nil
+	case plumbing.CommitObject:
+		return &SymLink{"../../../" + commitPath(obj.Hash().String()), p}, nil
+	case plumbing.TagObject:
+		content, err := readObject(obj)
+		if err != nil {
+			return nil, err
+		}
+		return &TextFile{content: content, path: p}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+/* the object's contents, without the "<type> <size>\0" header */
+func readObject(obj plumbing.EncodedObject) ([]byte, error) {
+	reader, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func rawObject(obj plumbing.EncodedObject) ([]byte, error) {
+	content, err := readObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	header := fmt.Sprintf("%s %d\x00", obj.Type(), len(content))
+	return append([]byte(header), content...), nil
+}
+
+/*
+commits, tags and blobs are already readable, trees are binary so we print
+them like `git cat-file -p` does:
+
+100644 blob 3c4e1e5fd8f5b5ebbd05b0e3b4bc06a0e29d7ea6	go.mod
+*/
+func prettyObject(repo *git.Repository, obj plumbing.EncodedObject) ([]byte, error) {
+	if obj.Type() != plumbing.TreeObject {
+		return readObject(obj)
+	}
+	tree, err := repo.TreeObject(obj.Hash())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, entry := range tree.Entries {
+		typ := plumbing.BlobObject
+		switch entry.Mode {
+		case filemode.Dir:
+			typ = plumbing.TreeObject
+		case filemode.Submodule:
+			typ = plumbing.CommitObject
+		}
+		fmt.Fprintf(&buf, "%06o %s %s\t%s\n", uint32(entry.Mode), typ, entry.Hash, entry.Name)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,50 @@
+package fuse
+
+import (
+	"context"
+	"testing"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+)
+
+func TestObjectsLookup(t *testing.T) {
+	repo, hashes := testRepo(t, map[string]string{"a.txt": "a\n"})
+	ctx := context.Background()
+	id := hashes[0].String()
+	var node fs.Node = &ObjectsDir{repo: repo}
+	for _, name := range []string{id[:2], id[:4], id} {
+		var err error
+		if node, err = node.(fs.NodeStringLookuper).Lookup(ctx, name); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	if _, ok := node.(*SymLink); !ok {
+		t.Errorf("a commit should be a symlink, got %T", node)
+	}
+	/* finding one object doesn't read all of them */
+	cachedObjectsLock.Lock()
+	if cachedObjects != nil {
+		t.Errorf("Lookup listed the objects")
+	}
+	cachedObjectsLock.Unlock()
+
+	tests := []struct {
+		node fs.NodeStringLookuper
+		name string
+	}{
+		{&ObjectsDir{repo: repo}, "a"},
+		{&ObjectsDir{repo: repo}, "zz"},
+		{&ObjectsPrefixDir{repo: repo, prefix: id[:2]}, id[:3]},
+		{&ObjectsPrefixDir{repo: repo, prefix: "00"}, id[:4]},
+		{&ObjectsPrefixDir2{repo: repo, prefix: id[:4]}, id[:10]},
+		{&ObjectsPrefixDir2{repo: repo, prefix: "0000"}, id},
+		{&CommitsDir{repo: repo}, "a"},
+		{&CommitsPrefixDir{repo: repo, prefix: id[:2]}, "a"},
+	}
+	for _, test := range tests {
+		if _, err := test.node.Lookup(ctx, test.name); err != fuse.ENOENT {
+			t.Errorf("%T.Lookup(%q): %v", test.node, test.name, err)
+		}
+	}
+}
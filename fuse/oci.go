@@ -0,0 +1,335 @@
+package fuse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  oci/<rev>/ is an OCI image layout
+  (https://github.com/opencontainers/image-spec/blob/main/image-layout.md)
+  with one image in it: a single layer with everything in the commit, so you
+  can make a container image from a commit without checking it out:
+
+  $ skopeo copy oci:/tmp/mntdir/oci/main docker-daemon:myimage:main
+
+  oci/<rev>/
+    oci-layout
+    index.json
+    blobs/sha256/<layer>     the files, as a tar (like archives/<rev>.tar)
+    blobs/sha256/<config>
+    blobs/sha256/<manifest>
+
+  Everything is named by its sha256, so to list blobs/ or read index.json we
+  have to make the whole layer once to hash it. We don't keep the layer, just
+  its hash and size (commits never change, so they stay right forever). It's
+  per commit and not per tree because the mtimes come from the commit.
+*/
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerType    = "application/vnd.oci.image.layer.v1.tar"
+)
+
+type OCIDir struct {
+	repo *git.Repository
+}
+
+/* oci/<rev>/ */
+type OCIImageDir struct {
+	repo   *git.Repository
+	commit *object.Commit
+	path   string
+}
+
+/* oci/<rev>/blobs and oci/<rev>/blobs/sha256 */
+type OCIBlobsDir struct {
+	image *OCIImageDir
+	path  string
+}
+
+/* the layer, we make it again every time someone reads it */
+type OCILayerFile struct {
+	repo  *git.Repository
+	tree  plumbing.Hash
+	size  int64
+	mtime time.Time
+	path  string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociLayer struct {
+	digest string
+	size   int64
+}
+
+/*
+the files don't depend on the architecture, but most tools want one. It's
+always the same so that the digests don't depend on where we're running
+*/
+const ociArchitecture = "amd64"
+
+/* like archiveSizes */
+const maxOCILayers = 10000
+
+var ociLayers = make(map[plumbing.Hash]ociLayer)
+var ociLayersLock sync.Mutex
+
+func (d *OCIDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Mtime = time.Unix(0, 0)
+	a.Ctime = time.Unix(0, 0)
+	a.Inode = inode("/oci")
+	return nil
+}
+
+/* the same as archives/, but folders */
+func (d *OCIDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	add := func(ref *plumbing.Reference) error {
+		entries = append(entries, fuse.Dirent{Name: ref.Name().Short(), Type: fuse.DT_Dir})
+		return nil
+	}
+	tags, err := d.repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tags.ForEach(add)
+	branches, err := d.repo.Branches()
+	if err != nil {
+		return nil, err
+	}
+	branches.ForEach(add)
+	return entries, nil
+}
+
+func (d *OCIDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	commit, err := resolveRev(d.repo, name)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &OCIImageDir{repo: d.repo, commit: commit, path: "/oci/" + name}, nil
+}
+
+func (d *OCIImageDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Mtime = d.commit.Committer.When
+	a.Ctime = a.Mtime
+	a.Inode = inode(d.path)
+	return nil
+}
+
+func (d *OCIImageDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Name: "oci-layout", Type: fuse.DT_File},
+		{Name: "index.json", Type: fuse.DT_File},
+		{Name: "blobs", Type: fuse.DT_Dir},
+	}, nil
+}
+
+func (d *OCIImageDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	p := d.path + "/" + name
+	switch name {
+	case "oci-layout":
+		return &TextFile{content: []byte(`{"imageLayoutVersion":"1.0.0"}`), path: p}, nil
+	case "index.json":
+		_, _, manifest, err := d.blobs()
+		if err != nil {
+			return nil, err
+		}
+		index, err := json.Marshal(map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.index.v1+json",
+			"manifests": []ociDescriptor{{
+				MediaType: ociManifestType,
+				Digest:    digest(manifest),
+				Size:      int64(len(manifest)),
+				/* `oci:<dir>:<ref>` in skopeo */
+				Annotations: map[string]string{"org.opencontainers.image.ref.name": getName(d.path)},
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &TextFile{content: index, path: p}, nil
+	case "blobs":
+		return &OCIBlobsDir{image: d, path: p}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+/* the layer (just its digest & size), the config and the manifest */
+func (d *OCIImageDir) blobs() (ociLayer, []byte, []byte, error) {
+	layer, err := d.layer()
+	if err != nil {
+		return ociLayer{}, nil, nil, err
+	}
+	created := d.commit.Committer.When.UTC()
+	config, err := json.Marshal(map[string]interface{}{
+		"created":      created,
+		"architecture": ociArchitecture,
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Labels": map[string]string{"org.opencontainers.image.revision": d.commit.Hash.String()},
+		},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []string{layer.digest},
+		},
+		"history": []map[string]interface{}{{
+			"created":    created,
+			"created_by": "git-commit-folders",
+			"comment":    strings.SplitN(d.commit.Message, "\n", 2)[0],
+		}},
+	})
+	if err != nil {
+		return ociLayer{}, nil, nil, err
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"config":        ociDescriptor{MediaType: ociConfigType, Digest: digest(config), Size: int64(len(config))},
+		"layers":        []ociDescriptor{{MediaType: ociLayerType, Digest: layer.digest, Size: layer.size}},
+		"annotations":   map[string]string{"org.opencontainers.image.revision": d.commit.Hash.String()},
+	})
+	if err != nil {
+		return ociLayer{}, nil, nil, err
+	}
+	return layer, config, manifest, nil
+}
+
+/* the layer isn't compressed, so its digest is also its diff_id */
+func (d *OCIImageDir) layer() (ociLayer, error) {
+	ociLayersLock.Lock()
+	layer, ok := ociLayers[d.commit.Hash]
+	ociLayersLock.Unlock()
+	if ok {
+		return layer, nil
+	}
+	h := sha256.New()
+	n := &countingWriter{w: h}
+	if err := d.layerFile().write(n); err != nil {
+		return ociLayer{}, err
+	}
+	layer = ociLayer{digest: "sha256:" + hex.EncodeToString(h.Sum(nil)), size: n.n}
+	ociLayersLock.Lock()
+	if len(ociLayers) >= maxOCILayers {
+		ociLayers = make(map[plumbing.Hash]ociLayer)
+	}
+	ociLayers[d.commit.Hash] = layer
+	ociLayersLock.Unlock()
+	return layer, nil
+}
+
+func (d *OCIImageDir) layerFile() *OCILayerFile {
+	return &OCILayerFile{repo: d.repo, tree: d.commit.TreeHash, mtime: d.commit.Committer.When}
+}
+
+func (d *OCIBlobsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Mtime = d.image.commit.Committer.When
+	a.Ctime = a.Mtime
+	a.Inode = inode(d.path)
+	return nil
+}
+
+func (d *OCIBlobsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	if getName(d.path) == "blobs" {
+		return []fuse.Dirent{{Name: "sha256", Type: fuse.DT_Dir}}, nil
+	}
+	layer, config, manifest, err := d.image.blobs()
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for _, dgst := range []string{layer.digest, digest(config), digest(manifest)} {
+		entries = append(entries, fuse.Dirent{Name: strings.TrimPrefix(dgst, "sha256:"), Type: fuse.DT_File})
+	}
+	return entries, nil
+}
+
+func (d *OCIBlobsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	p := d.path + "/" + name
+	if getName(d.path) == "blobs" {
+		if name == "sha256" {
+			return &OCIBlobsDir{image: d.image, path: p}, nil
+		}
+		return nil, fuse.ENOENT
+	}
+	layer, config, manifest, err := d.image.blobs()
+	if err != nil {
+		return nil, err
+	}
+	switch "sha256:" + name {
+	case layer.digest:
+		f := d.image.layerFile()
+		f.size = layer.size
+		f.path = p
+		return f, nil
+	case digest(config):
+		return &TextFile{content: config, path: p}, nil
+	case digest(manifest):
+		return &TextFile{content: manifest, path: p}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (f *OCILayerFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	a.Size = uint64(f.size)
+	a.Mtime = f.mtime
+	a.Ctime = f.mtime
+	a.Inode = inode(f.path)
+	return nil
+}
+
+/* like archives/, so that the layer never has to be in memory all at once */
+func (f *OCILayerFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenDirectIO
+	return &archiveHandle{write: f.write}, nil
+}
+
+func (f *OCILayerFile) write(w io.Writer) error {
+	a := &archiver{repo: f.repo, mtime: f.mtime}
+	return a.writeTar(w, f.tree, "")
+}
+
+func digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func getName(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,36 @@
+package fuse
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+/* the same commit has to make the same image everywhere */
+func TestOCIConfig(t *testing.T) {
+	repo, hashes := testRepo(t, map[string]string{"a.txt": "a\n"})
+	commit, err := repo.CommitObject(hashes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &OCIImageDir{repo: repo, commit: commit, path: "/oci/" + hashes[0].String()}
+	layer, config, _, err := d.blobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	}
+	if err := json.Unmarshal(config, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Architecture != ociArchitecture || c.OS != "linux" {
+		t.Errorf("config: %+v", c)
+	}
+	ociLayersLock.Lock()
+	cached := ociLayers[hashes[0]]
+	ociLayersLock.Unlock()
+	if cached != layer {
+		t.Errorf("cached layer %+v, want %+v", cached, layer)
+	}
+}
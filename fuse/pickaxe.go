@@ -0,0 +1,314 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  pickaxe/<string>/ is like `git log -S <string>`: it lists the commits
+  reachable from HEAD (newest first) whose diff changes the number of times
+  <string> appears, as
+
+  00-<hash> -> ../../commits/ab/abcd/<hash>
+  00-<hash>.patch (just the hunks that mention <string>)
+*/
+
+type PickaxeDir struct {
+	repo *git.Repository
+}
+
+type PickaxeSearchDir struct {
+	repo   *git.Repository
+	needle string
+}
+
+func (f *PickaxeDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/pickaxe")
+	return nil
+}
+
+func (f *PickaxeDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	/* there's no way to list every possible search string */
+	return []fuse.Dirent{}, nil
+}
+
+func (f *PickaxeDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	return &PickaxeSearchDir{repo: f.repo, needle: name}, nil
+}
+
+func (f *PickaxeSearchDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	a.Inode = inode("/pickaxe/" + f.needle)
+	return nil
+}
+
+func (f *PickaxeSearchDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	matches, err := pickaxeSearch(f.repo, f.needle)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	for i, hash := range matches {
+		name := fmt.Sprintf("%02d-%s", i, hash.String())
+		entries = append(entries, fuse.Dirent{
+			Name: name,
+			Type: fuse.DT_Link,
+		})
+		entries = append(entries, fuse.Dirent{
+			Name: name + ".patch",
+			Type: fuse.DT_File,
+		})
+	}
+	return entries, nil
+}
+
+func (f *PickaxeSearchDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	isPatch := strings.HasSuffix(name, ".patch")
+	_, hash, ok := strings.Cut(strings.TrimSuffix(name, ".patch"), "-")
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	matches, err := pickaxeSearch(f.repo, f.needle)
+	if err != nil {
+		return nil, err
+	}
+	for _, match := range matches {
+		if match.String() != hash {
+			continue
+		}
+		if !isPatch {
+			return &SymLink{"../../" + commitPath(hash), "/pickaxe/" + f.needle + "/" + name}, nil
+		}
+		patch, err := pickaxePatch(f.repo, match, f.needle)
+		if err != nil {
+			return nil, err
+		}
+		return &TextFile{content: []byte(patch), path: "/pickaxe/" + f.needle + "/" + name}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+/*
+results never change for a given HEAD, so cache them by HEAD + search string.
+A search can take a long time in a big repo, so we don't hold the lock while
+searching: the first lookup for a key does the search and the others wait for
+it, without blocking lookups for other keys.
+*/
+type pickaxeResult struct {
+	done    chan struct{}
+	matches []plumbing.Hash
+	err     error
+}
+
+var pickaxeCache = make(map[string]*pickaxeResult)
+var pickaxeCacheLock sync.Mutex
+
+func pickaxeSearch(repo *git.Repository, needle string) ([]plumbing.Hash, error) {
+	head, err := repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	key := head.Hash().String() + ":" + needle
+	pickaxeCacheLock.Lock()
+	result, ok := pickaxeCache[key]
+	if !ok {
+		/* don't use up all the memory */
+		if len(pickaxeCache) > 1000 {
+			pickaxeCache = make(map[string]*pickaxeResult)
+		}
+		result = &pickaxeResult{done: make(chan struct{})}
+		pickaxeCache[key] = result
+	}
+	pickaxeCacheLock.Unlock()
+	if ok {
+		<-result.done
+		return result.matches, result.err
+	}
+
+	result.matches, result.err = searchCommits(repo, head.Hash(), needle)
+	if result.err != nil {
+		/* try again next time */
+		pickaxeCacheLock.Lock()
+		if pickaxeCache[key] == result {
+			delete(pickaxeCache, key)
+		}
+		pickaxeCacheLock.Unlock()
+	}
+	close(result.done)
+	return result.matches, result.err
+}
+
+func searchCommits(repo *git.Repository, head plumbing.Hash, needle string) ([]plumbing.Hash, error) {
+	commits, err := repo.Log(&git.LogOptions{From: head, Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return nil, err
+	}
+	matches := []plumbing.Hash{}
+	err = commits.ForEach(func(commit *object.Commit) error {
+		/* like git log, don't look at merge diffs */
+		if commit.NumParents() > 1 {
+			return nil
+		}
+		changes, err := commitChanges(commit)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			changed, err := countChanged(change, needle)
+			if err != nil {
+				return err
+			}
+			if changed {
+				matches = append(matches, commit.Hash)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("pickaxe %s: %w", needle, err)
+	}
+	return matches, nil
+}
+
+/*
+diff against the first parent, or against nothing for root commits. Renames
+are detected so that moving a file doesn't count as removing every string in it
+*/
+func commitChanges(commit *object.Commit) (object.Changes, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var parentTree *object.Tree
+	if commit.NumParents() > 0 {
+		parent, err := commit.Parent(0)
+		if err != nil {
+			return nil, err
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return object.DiffTreeWithOptions(context.Background(), parentTree, tree, object.DefaultDiffTreeOptions)
+}
+
+func countChanged(change *object.Change, needle string) (bool, error) {
+	from, to, err := change.Files()
+	if err != nil {
+		return false, err
+	}
+	before, err := countInFile(from, needle)
+	if err != nil {
+		return false, err
+	}
+	after, err := countInFile(to, needle)
+	if err != nil {
+		return false, err
+	}
+	return before != after, nil
+}
+
+func countInFile(file *object.File, needle string) (int, error) {
+	if file == nil {
+		return 0, nil
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return 0, err
+	}
+	return strings.Count(content, needle), nil
+}
+
+func pickaxePatch(repo *git.Repository, id plumbing.Hash, needle string) (string, error) {
+	commit, err := repo.CommitObject(id)
+	if err != nil {
+		return "", err
+	}
+	changes, err := commitChanges(commit)
+	if err != nil {
+		return "", err
+	}
+	var matching object.Changes
+	for _, change := range changes {
+		changed, err := countChanged(change, needle)
+		if err != nil {
+			return "", err
+		}
+		if changed {
+			matching = append(matching, change)
+		}
+	}
+	patch, err := matching.Patch()
+	if err != nil {
+		return "", err
+	}
+	return filterHunks(patch.String(), needle), nil
+}
+
+/*
+only keep the hunks with an added or removed line containing needle. If
+needle spans several lines no single line will match, so in that case we
+keep every hunk for the file.
+*/
+func filterHunks(patch string, needle string) string {
+	var out strings.Builder
+	var header []string
+	var hunks [][]string
+
+	flush := func() {
+		var keep [][]string
+		for _, hunk := range hunks {
+			for _, line := range hunk[1:] {
+				if (strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")) && strings.Contains(line, needle) {
+					keep = append(keep, hunk)
+					break
+				}
+			}
+		}
+		if len(keep) == 0 {
+			keep = hunks
+		}
+		for _, line := range header {
+			out.WriteString(line + "\n")
+		}
+		for _, hunk := range keep {
+			for _, line := range hunk {
+				out.WriteString(line + "\n")
+			}
+		}
+		header, hunks = nil, nil
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(patch, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			if header != nil {
+				flush()
+			}
+			header = []string{line}
+		case strings.HasPrefix(line, "@@"):
+			hunks = append(hunks, []string{line})
+		case len(hunks) > 0:
+			hunks[len(hunks)-1] = append(hunks[len(hunks)-1], line)
+		default:
+			header = append(header, line)
+		}
+	}
+	if header != nil {
+		flush()
+	}
+	return out.String()
+}
@@ -0,0 +1,269 @@
+package fuse
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/anacrolix/fuse"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+/*
+  Changing refs through the mount (only with -writable-refs).
+
+  We remember which commit we last showed for each ref. If the ref has moved
+  since then (because of a `git commit` or a `git push` or whatever), we refuse
+  to move or delete it, so you can't accidentally throw away a commit you
+  didn't know about.
+*/
+
+type refWriter struct {
+	repo *git.Repository
+	lock sync.Mutex
+	seen map[plumbing.ReferenceName]plumbing.Hash
+	/* messages for annotated tags that haven't been created yet, see new_tags.go */
+	tagMessages map[string][]byte
+}
+
+func newRefWriter(repo *git.Repository) *refWriter {
+	return &refWriter{
+		repo:        repo,
+		seen:        make(map[plumbing.ReferenceName]plumbing.Hash),
+		tagMessages: make(map[string][]byte),
+	}
+}
+
+/* called every time we show a ref to someone */
+func (w *refWriter) saw(name plumbing.ReferenceName, hash plumbing.Hash) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.seen[name] = hash
+}
+
+func (w *refWriter) create(name plumbing.ReferenceName, hash plumbing.Hash) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, err := w.repo.Storer.Reference(name); err == nil {
+		return fuse.EEXIST
+	}
+	if err := w.repo.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return err
+	}
+	log.Printf("created %s at %s", name, hash)
+	w.seen[name] = hash
+	return nil
+}
+
+/* compare-and-swap: only move the ref if it still points where we last saw it */
+func (w *refWriter) update(name plumbing.ReferenceName, hash plumbing.Hash) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	old, err := w.checkUnchanged(name)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		err = w.repo.Storer.SetReference(plumbing.NewHashReference(name, hash))
+	} else {
+		err = w.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(name, hash), old)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("moved %s to %s", name, hash)
+	w.seen[name] = hash
+	return nil
+}
+
+func (w *refWriter) remove(name plumbing.ReferenceName) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	old, err := w.checkUnchanged(name)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fuse.ENOENT
+	}
+	/* like `git branch -d`, don't delete the branch that's checked out */
+	if w.checkedOut(name) {
+		log.Printf("not deleting %s: it's checked out", name)
+		return fuse.Errno(syscall.EBUSY)
+	}
+	if err := w.repo.Storer.RemoveReference(name); err != nil {
+		return err
+	}
+	log.Printf("deleted %s (was %s)", name, old.Hash())
+	delete(w.seen, name)
+	return nil
+}
+
+/*
+git can't rename a ref in one step, so we make the new one and then delete the
+old one. If deleting the old one fails, the new one goes back to how it was, so
+you never end up with both
+*/
+func (w *refWriter) rename(oldName, newName plumbing.ReferenceName) error {
+	if err := checkRefName(newName); err != nil {
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	old, err := w.checkUnchanged(oldName)
+	if err != nil {
+		return err
+	}
+	if old == nil {
+		return fuse.ENOENT
+	}
+	if w.checkedOut(oldName) {
+		log.Printf("not renaming %s: it's checked out", oldName)
+		return fuse.Errno(syscall.EBUSY)
+	}
+	previous, err := w.checkUnchanged(newName)
+	if err != nil {
+		return err
+	}
+	if w.checkedOut(newName) {
+		log.Printf("not renaming %s over %s: it's checked out", oldName, newName)
+		return fuse.Errno(syscall.EBUSY)
+	}
+	ref := plumbing.NewHashReference(newName, old.Hash())
+	if previous == nil {
+		err = w.repo.Storer.SetReference(ref)
+	} else {
+		err = w.repo.Storer.CheckAndSetReference(ref, previous)
+	}
+	if err != nil {
+		return err
+	}
+	if err := w.repo.Storer.RemoveReference(oldName); err != nil {
+		var undoErr error
+		if previous == nil {
+			undoErr = w.repo.Storer.RemoveReference(newName)
+		} else {
+			undoErr = w.repo.Storer.CheckAndSetReference(previous, ref)
+		}
+		if undoErr != nil {
+			log.Printf("couldn't put %s back after failing to delete %s: %s", newName, oldName, undoErr)
+		}
+		return fmt.Errorf("deleting %s: %w", oldName, err)
+	}
+	log.Printf("renamed %s to %s (%s)", oldName, newName, old.Hash())
+	delete(w.seen, oldName)
+	w.seen[newName] = old.Hash()
+	return nil
+}
+
+/*
+the rules from `git check-ref-format`, so that we don't make refs that git
+won't read (like "refs/heads/a..b" or "refs/heads/x.lock")
+*/
+func checkRefName(name plumbing.ReferenceName) error {
+	short := name.Short()
+	if err := refNameError(string(name), short); err != "" {
+		log.Printf("%q isn't a valid ref name: %s", short, err)
+		return fuse.Errno(syscall.EINVAL)
+	}
+	return nil
+}
+
+func refNameError(name, short string) string {
+	switch {
+	case short == "" || short == "@" || short == "HEAD":
+		return "reserved name"
+	case strings.HasSuffix(name, "/") || strings.Contains(name, "//"):
+		return "empty path component"
+	case strings.HasSuffix(name, "."):
+		return "ends with ."
+	case strings.Contains(name, ".."):
+		return "contains .."
+	case strings.Contains(name, "@{"):
+		return "contains @{"
+	case strings.ContainsAny(name, " ~^:?*[\\"):
+		return "contains a special character"
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return "contains a control character"
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") || strings.HasSuffix(component, ".lock") {
+			return "a component starts with . or ends with .lock"
+		}
+	}
+	return ""
+}
+
+func (w *refWriter) checkedOut(name plumbing.ReferenceName) bool {
+	head, err := w.repo.Storer.Reference(plumbing.HEAD)
+	return err == nil && head.Type() == plumbing.SymbolicReference && head.Target() == name
+}
+
+/* returns the current value of the ref, or nil if it doesn't exist */
+func (w *refWriter) checkUnchanged(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	current, err := w.repo.Storer.Reference(name)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if seen, ok := w.seen[name]; ok && seen != current.Hash() {
+		log.Printf("not changing %s: it moved from %s to %s", name, seen, current.Hash())
+		return nil, fuse.Errno(syscall.EBUSY)
+	}
+	return current, nil
+}
+
+/*
+figure out which commit a symlink target like ../commits/ab/abcd/<hash> is
+pointing to. We only look at the last path component, so absolute paths into
+the mount work too.
+*/
+func commitFromLinkTarget(repo *git.Repository, target string) (plumbing.Hash, error) {
+	id := path.Base(strings.TrimSuffix(target, "/"))
+	if !plumbing.IsHash(id) {
+		return plumbing.ZeroHash, fmt.Errorf("%s doesn't point at a commit: %w", target, fuse.Errno(syscall.EINVAL))
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(id))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("%s doesn't point at a commit: %w", target, fuse.Errno(syscall.EINVAL))
+	}
+	return commit.Hash, nil
+}
+
+/*
+like update, but for when we read the ref ourselves instead of showing it to
+someone: only move it if it's still at `old`
+*/
+func (w *refWriter) updateFrom(name plumbing.ReferenceName, old plumbing.Hash, hash plumbing.Hash) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	current, err := w.repo.Storer.Reference(name)
+	if err != nil {
+		return err
+	}
+	if current.Hash() != old {
+		log.Printf("not changing %s: it moved from %s to %s", name, old, current.Hash())
+		return fuse.Errno(syscall.EBUSY)
+	}
+	if err := w.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(name, hash), current); err != nil {
+		return err
+	}
+	log.Printf("moved %s from %s to %s", name, old, hash)
+	w.seen[name] = hash
+	return nil
+}
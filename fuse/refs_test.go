@@ -0,0 +1,49 @@
+package fuse
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/anacrolix/fuse"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestCheckRefName(t *testing.T) {
+	for _, name := range []string{"main", "feature/x", "v1.2.3", "a-b_c", "fix@home"} {
+		if err := checkRefName(plumbing.NewBranchReferenceName(name)); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+	for _, name := range []string{
+		"", "HEAD", "@", "a..b", "a.lock", "x/a.lock/b", ".hidden", "x/.hidden", "a/", "a//b", "a.",
+		"a~1", "a^", "a:b", "a?", "a*", "a[", "a\\b", "a b", "a@{1}", "a\x01",
+	} {
+		if err := checkRefName(plumbing.NewBranchReferenceName(name)); err != fuse.Errno(syscall.EINVAL) {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+}
+
+func TestRefWriterBadNames(t *testing.T) {
+	repo, hashes := testRepo(t, map[string]string{"a.txt": "a\n"})
+	w := newRefWriter(repo)
+	if err := w.create(plumbing.NewBranchReferenceName("x.lock"), hashes[0]); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("create: %v", err)
+	}
+	if _, err := repo.Storer.Reference(plumbing.NewBranchReferenceName("x.lock")); err == nil {
+		t.Errorf("create made the ref anyway")
+	}
+	if err := w.create(plumbing.NewBranchReferenceName("other"), hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.rename(plumbing.NewBranchReferenceName("other"), plumbing.NewBranchReferenceName("a..b")); err != fuse.Errno(syscall.EINVAL) {
+		t.Errorf("rename to a bad name: %v", err)
+	}
+	/* HEAD points at master */
+	if err := w.rename(plumbing.NewBranchReferenceName("other"), plumbing.Master); err != fuse.Errno(syscall.EBUSY) {
+		t.Errorf("rename over the checked out branch: %v", err)
+	}
+	if _, err := repo.Storer.Reference(plumbing.NewBranchReferenceName("other")); err != nil {
+		t.Errorf("other is gone: %v", err)
+	}
+}
@@ -2,49 +2,67 @@ package fuse
 
 import (
 	"context"
-	"log"
 	"os"
 
 	"github.com/anacrolix/fuse"
 	"github.com/anacrolix/fuse/fs"
 	_ "github.com/anacrolix/fuse/fs/fstestutil"
 	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 )
 
-func Run(repo *git.Repository, mountpoint string) {
-	defer fuse.Unmount(mountpoint) // TODO: doesn't seem to work
-	c, err := fuse.Mount(
-		mountpoint,
-		fuse.FSName("helloworld"),
-		fuse.Subtype("hellofs"),
-		fuse.LocalVolume(),
-		fuse.VolumeName("Hello world!"),
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer c.Close()
-
-	err = fs.Serve(c, &FS{repo})
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		log.Fatal(err)
-	}
-}
-
 // FS implements the hello world file system.
 type FS struct {
 	repo *git.Repository
+	/* nil unless refs are writable */
+	refs      *refWriter
+	forceTags bool
+	/* nil unless workspaces are enabled */
+	workspaces *Workspaces
+	/* nil unless refs are writable */
+	actions *Actions
+	/* see watch.go */
+	changes *refChanges
+	/* these need to stay the same so that we can tell the kernel what changed */
+	branches        *BranchesDir
+	tags            *TagsDir
+	branchHistories *BranchHistoriesDir
+	/* nil unless -hardlink-blobs */
+	links *blobLinks
 }
 
-func New(repo *git.Repository) *FS {
+type Options struct {
+	/* let people create, move and delete branches with ln -s and rm */
+	WritableRefs bool
+	/* with WritableRefs, also let people replace and delete existing tags */
+	ForceTags bool
+	/* add a workspaces/ folder where you can edit files and make commits */
+	Workspaces bool
+	/* identical files in commits/ share an inode, see hardlinks.go */
+	HardlinkBlobs bool
+}
+
+func New(repo *git.Repository, opts Options) *FS {
 	// start a goroutine to cache the commits
 	go getPackedCommits(repo)
-	return &FS{repo: repo}
+	f := &FS{repo: repo, forceTags: opts.ForceTags}
+	if opts.WritableRefs {
+		f.refs = newRefWriter(repo)
+		f.actions = newActions(repo, f.refs)
+	}
+	if opts.Workspaces {
+		f.workspaces = newWorkspaces(repo)
+	}
+	if opts.HardlinkBlobs {
+		f.links = newBlobLinks(repo)
+		// counting takes a while, so start now (it happens in the background)
+		f.links.count(plumbing.ZeroHash)
+	}
+	f.changes = newRefChanges()
+	f.branches = &BranchesDir{repo: repo, refs: f.refs, changes: f.changes}
+	f.tags = &TagsDir{repo: repo, refs: f.refs, force: f.forceTags, changes: f.changes}
+	f.branchHistories = &BranchHistoriesDir{repo: repo, changes: f.changes}
+	return f
 }
 
 func (f *FS) Root() (fs.Node, error) {
@@ -58,24 +76,57 @@ func (f *FS) Attr(ctx context.Context, a *fuse.Attr) error {
 }
 
 func (f *FS) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
-	return []fuse.Dirent{
+	entries := []fuse.Dirent{
 		{Name: "commits", Type: fuse.DT_Dir},
 		{Name: "branches", Type: fuse.DT_Dir},
 		{Name: "tags", Type: fuse.DT_Dir},
 		{Name: "branch_histories", Type: fuse.DT_Dir},
-	}, nil
+		{Name: "pickaxe", Type: fuse.DT_Dir},
+		{Name: "blame", Type: fuse.DT_Dir},
+		{Name: "file_log", Type: fuse.DT_Dir},
+		{Name: "objects", Type: fuse.DT_Dir},
+		{Name: "archives", Type: fuse.DT_Dir},
+		{Name: "oci", Type: fuse.DT_Dir},
+	}
+	if f.actions != nil {
+		entries = append(entries, fuse.Dirent{Name: "actions", Type: fuse.DT_Dir})
+	}
+	if f.workspaces != nil {
+		entries = append(entries, fuse.Dirent{Name: "workspaces", Type: fuse.DT_Dir})
+	}
+	return entries, nil
 }
 
 func (f *FS) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	switch name {
 	case "commits":
-		return &CommitsDir{repo: f.repo}, nil
+		return &CommitsDir{repo: f.repo, links: f.links}, nil
 	case "branches":
-		return &BranchesDir{repo: f.repo}, nil
+		return f.branches, nil
 	case "tags":
-		return &TagsDir{repo: f.repo}, nil
+		return f.tags, nil
 	case "branch_histories":
-		return &BranchHistoriesDir{repo: f.repo}, nil
+		return f.branchHistories, nil
+	case "pickaxe":
+		return &PickaxeDir{repo: f.repo}, nil
+	case "blame":
+		return &BlameDir{repo: f.repo}, nil
+	case "file_log":
+		return &FileLogDir{repo: f.repo}, nil
+	case "objects":
+		return &ObjectsDir{repo: f.repo}, nil
+	case "archives":
+		return &ArchivesDir{repo: f.repo}, nil
+	case "oci":
+		return &OCIDir{repo: f.repo}, nil
+	case "actions":
+		if f.actions != nil {
+			return &ActionsDir{actions: f.actions}, nil
+		}
+	case "workspaces":
+		if f.workspaces != nil {
+			return &WorkspacesDir{workspaces: f.workspaces}, nil
+		}
 	}
 	return nil, fuse.ENOENT
 }
@@ -10,6 +10,8 @@ import (
 
 type SymLink struct {
 	content string
+	/* where it is in the mount, for the inode */
+	path string
 }
 
 func (s *SymLink) Attr(ctx context.Context, a *fuse.Attr) error {
@@ -17,11 +19,23 @@ func (s *SymLink) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Size = uint64(len(s.content))
 	a.Mtime = time.Unix(0, 0)
 	a.Ctime = time.Unix(0, 0)
-	/* TODO: is it bad to define the inode this way? */
-	a.Inode = inode(s.content)
+	a.Inode = inode(s.path)
 	return nil
 }
 
 func (s *SymLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
 	return s.content, nil
 }
+
+/* a branch or tag: the mtime is when the ref last moved, so that NFS clients notice */
+type RefSymLink struct {
+	SymLink
+	mtime time.Time
+}
+
+func (s *RefSymLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	s.SymLink.Attr(ctx, a)
+	a.Mtime = s.mtime
+	a.Ctime = s.mtime
+	return nil
+}
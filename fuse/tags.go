@@ -3,7 +3,7 @@ package fuse
 import (
 	"context"
 	"os"
-	"time"
+	"syscall"
 
 	"github.com/anacrolix/fuse"
 	"github.com/anacrolix/fuse/fs"
@@ -13,6 +13,11 @@ import (
 
 type TagsDir struct {
 	repo *git.Repository
+	/* nil unless the mount has -writable-refs */
+	refs *refWriter
+	/* replace & delete existing tags instead of refusing to */
+	force   bool
+	changes *refChanges
 }
 
 func (f *TagsDir) Root() (fs.Node, error) {
@@ -21,8 +26,11 @@ func (f *TagsDir) Root() (fs.Node, error) {
 
 func (f *TagsDir) Attr(ctx context.Context, a *fuse.Attr) error {
 	a.Mode = os.ModeDir | 0o555
-	a.Mtime = time.Unix(0, 0)
-	a.Ctime = time.Unix(0, 0)
+	if f.refs != nil {
+		a.Mode = os.ModeDir | 0o755
+	}
+	a.Mtime = f.changes.mtime("/tags")
+	a.Ctime = a.Mtime
 	a.Inode = inode("/tags")
 	return nil
 }
@@ -40,17 +48,69 @@ func (f *TagsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 		})
 		return nil
 	})
+	if f.refs != nil {
+		entries = append(entries, fuse.Dirent{Name: ".new", Type: fuse.DT_Dir})
+	}
 	return entries, nil
 }
 
 func (f *TagsDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if name == ".new" && f.refs != nil {
+		return &NewTagsDir{repo: f.repo, refs: f.refs, force: f.force}, nil
+	}
 	refName := plumbing.ReferenceName("refs/tags/" + name)
 	// we need to resolve the reference in case it's symbolic
-	// TODO: this doesn't seem to work for the tags in git's own repo
 	ref, err := f.repo.Reference(refName, true)
 	if err != nil {
 		return nil, fuse.ENOENT
 	}
-	id := ref.Hash().String()
-	return &SymLink{"../" + commitPath(id)}, nil
+	if f.refs != nil {
+		f.refs.saw(ref.Name(), ref.Hash())
+	}
+	id := peelTag(f.repo, ref.Hash()).String()
+	link := &RefSymLink{SymLink{"../" + commitPath(id), "/tags/" + name}, f.changes.mtime("/tags/" + name)}
+	return f.changes.lookedUp("/tags/"+name, link), nil
+}
+
+/* annotated tags point at a tag object instead of a commit, so follow it */
+func peelTag(repo *git.Repository, hash plumbing.Hash) plumbing.Hash {
+	for {
+		tag, err := repo.TagObject(hash)
+		if err != nil {
+			return hash
+		}
+		hash = tag.Target
+	}
+}
+
+/* ln -s ../commits/ab/abcd/<hash> tags/v1.2.3 makes a lightweight tag */
+func (f *TagsDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	if f.refs == nil {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
+	hash, err := commitFromLinkTarget(f.repo, req.Target)
+	if err != nil {
+		return nil, err
+	}
+	name := plumbing.NewTagReferenceName(req.NewName)
+	if f.force {
+		err = f.refs.update(name, hash)
+	} else {
+		err = f.refs.create(name, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SymLink{"../" + commitPath(hash.String()), "/tags/" + req.NewName}, nil
+}
+
+/* tags aren't supposed to change, so you can only delete them in force mode */
+func (f *TagsDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if f.refs == nil {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if !f.force {
+		return fuse.EPERM
+	}
+	return f.refs.remove(plumbing.NewTagReferenceName(req.Name))
 }
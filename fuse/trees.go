@@ -0,0 +1,57 @@
+package fuse
+
+import (
+	"sync"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  Parsed trees, cached by hash. Without this, every Lookup in a directory
+  re-reads and re-parses the whole tree and then looks through all of the
+  entries, so looking up every file in a directory with 5000 files is really
+  slow. Trees never change, so we can keep them as long as we want.
+*/
+
+type cachedTree struct {
+	Entries []object.TreeEntry
+	byName  map[string]int
+}
+
+var treeCache = make(map[plumbing.Hash]*cachedTree)
+var treeCacheLock sync.Mutex
+
+func getTree(repo *git.Repository, id plumbing.Hash) (*cachedTree, error) {
+	treeCacheLock.Lock()
+	tree, ok := treeCache[id]
+	treeCacheLock.Unlock()
+	if ok {
+		return tree, nil
+	}
+	obj, err := repo.TreeObject(id)
+	if err != nil {
+		return nil, err
+	}
+	tree = &cachedTree{Entries: obj.Entries, byName: make(map[string]int, len(obj.Entries))}
+	for i, entry := range obj.Entries {
+		tree.byName[entry.Name] = i
+	}
+	treeCacheLock.Lock()
+	defer treeCacheLock.Unlock()
+	/* don't use up all the memory */
+	if len(treeCache) > 10000 {
+		treeCache = make(map[plumbing.Hash]*cachedTree)
+	}
+	treeCache[id] = tree
+	return tree, nil
+}
+
+func (t *cachedTree) entry(name string) (object.TreeEntry, bool) {
+	i, ok := t.byName[name]
+	if !ok {
+		return object.TreeEntry{}, false
+	}
+	return t.Entries[i], true
+}
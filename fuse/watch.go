@@ -0,0 +1,270 @@
+package fuse
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	"github.com/fsnotify/fsnotify"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+/*
+  Watching .git for refs that move (because of `git commit`, `git fetch`,
+  etc), so that branches/main doesn't keep pointing at the old commit.
+
+  There are 2 parts to this:
+
+  1. the kernel's FUSE cache: we tell it to forget about branches/main (and
+     what it read from the branches/main symlink)
+  2. NFS & WebDAV clients: they decide whether their cache is stale by looking
+     at the mtime, so we keep track of when each thing last changed and use
+     that as the mtime.
+*/
+
+/* the parts of *fs.Server we need (it's nil for NFS & WebDAV) */
+type Invalidator interface {
+	InvalidateEntry(parent fs.Node, name string) error
+	InvalidateNodeAttr(node fs.Node) error
+	InvalidateNodeData(node fs.Node) error
+}
+
+type refChanges struct {
+	lock sync.Mutex
+	/* "/branches/main" -> when main last moved */
+	times map[string]time.Time
+	/* "/branches/main" -> the node we last gave the kernel for it */
+	nodes map[string]fs.Node
+}
+
+type refWatcher struct {
+	fs      *FS
+	inv     Invalidator
+	watcher *fsnotify.Watcher
+	refs    map[plumbing.ReferenceName]plumbing.Hash
+}
+
+func newRefChanges() *refChanges {
+	return &refChanges{times: make(map[string]time.Time), nodes: make(map[string]fs.Node)}
+}
+
+/* the mtime for `path`. Nil-safe so that nodes don't need to care whether there's a watcher */
+func (c *refChanges) mtime(path string) time.Time {
+	if c == nil {
+		return time.Unix(0, 0)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t, ok := c.times[path]; ok {
+		return t
+	}
+	return time.Unix(0, 0)
+}
+
+/* remember the node for `path`, so that we can invalidate it when the ref moves */
+func (c *refChanges) lookedUp(path string, node fs.Node) fs.Node {
+	if c == nil {
+		return node
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.nodes[path] = node
+	return node
+}
+
+func (c *refChanges) forget(path string) fs.Node {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	node := c.nodes[path]
+	delete(c.nodes, path)
+	return node
+}
+
+func (c *refChanges) touch(paths ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	for _, path := range paths {
+		c.times[path] = now
+	}
+}
+
+/*
+start watching the repository's refs. `inv` is the FUSE server if there is
+one, otherwise nil. Close the watcher to stop.
+*/
+func (f *FS) WatchRefs(inv Invalidator) (io.Closer, error) {
+	storage, ok := f.repo.Storer.(*filesystem.Storage)
+	if !ok {
+		/* an in-memory repo, nothing to watch */
+		return io.NopCloser(nil), nil
+	}
+	gitDir := storage.Filesystem().Root()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	/*
+	  git updates refs by writing a .lock file and renaming it, so we watch
+	  the directories instead of the files. fsnotify isn't recursive, so every
+	  directory under refs/ needs its own watch.
+	*/
+	if err := watcher.Add(gitDir); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	if err := addRecursive(watcher, filepath.Join(gitDir, "refs")); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	w := &refWatcher{fs: f, inv: inv, watcher: watcher, refs: readRefs(f.repo)}
+	go w.run()
+	return w, nil
+}
+
+/* run() stops when the watcher's channels get closed */
+func (w *refWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+func addRecursive(watcher *fsnotify.Watcher, dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (w *refWatcher) run() {
+	/* wait until things are quiet for a bit, `git fetch` changes lots of refs at once */
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					addRecursive(w.watcher, event.Name)
+				}
+			}
+			if isRefFile(event.Name) {
+				timer.Reset(100 * time.Millisecond)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("error watching refs: %s", err)
+		case <-timer.C:
+			w.refresh()
+		}
+	}
+}
+
+/* ignore objects, index, lock files, etc */
+func isRefFile(path string) bool {
+	if strings.HasSuffix(path, ".lock") {
+		return false
+	}
+	name := filepath.Base(path)
+	return name == "HEAD" || name == "packed-refs" || strings.Contains(filepath.ToSlash(path), "/refs/")
+}
+
+func readRefs(repo *git.Repository) map[plumbing.ReferenceName]plumbing.Hash {
+	refs := make(map[plumbing.ReferenceName]plumbing.Hash)
+	iter, err := repo.References()
+	if err != nil {
+		return refs
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return refs
+}
+
+func (w *refWatcher) refresh() {
+	refs := readRefs(w.fs.repo)
+	var changed []plumbing.ReferenceName
+	for name, hash := range refs {
+		if old, ok := w.refs[name]; !ok || old != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range w.refs {
+		if _, ok := refs[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	w.refs = refs
+	for _, name := range changed {
+		log.Printf("%s changed", name)
+		w.invalidate(name)
+	}
+}
+
+func (w *refWatcher) invalidate(name plumbing.ReferenceName) {
+	f := w.fs
+	short := name.Short()
+	switch {
+	case name.IsBranch():
+		f.changes.touch("/branches", "/branches/"+short, "/branch_histories", "/branch_histories/"+short)
+		w.invalidateEntry(f.branches, "/branches", short)
+		w.invalidateEntry(f.branchHistories, "/branch_histories", short)
+	case name.IsTag():
+		f.changes.touch("/tags", "/tags/"+short)
+		w.invalidateEntry(f.tags, "/tags", short)
+	}
+}
+
+/*
+makes the kernel look up `name` in `dir` again, and forget what it read from
+the node it had for it (the symlink's target, or branch_histories/<name>/'s
+files).
+
+Refs with a / in them (like feature/x) aren't a folder in the mount, so the
+closest thing the kernel can have cached is `feature`, and the listing.
+*/
+func (w *refWatcher) invalidateEntry(dir fs.Node, dirPath string, name string) {
+	node := w.fs.changes.forget(dirPath + "/" + name)
+	if w.inv == nil {
+		return
+	}
+	entry := strings.SplitN(name, "/", 2)[0]
+	/* ErrNotCached just means the kernel hasn't looked at it yet */
+	if err := w.inv.InvalidateEntry(dir, entry); err != nil && err != fuse.ErrNotCached {
+		log.Printf("error invalidating %s: %s", name, err)
+	}
+	if node != nil {
+		if err := w.inv.InvalidateNodeData(node); err != nil && err != fuse.ErrNotCached {
+			log.Printf("error invalidating %s: %s", name, err)
+		}
+		if err := w.inv.InvalidateNodeAttr(node); err != nil && err != fuse.ErrNotCached {
+			log.Printf("error invalidating %s: %s", name, err)
+		}
+	}
+	if err := w.inv.InvalidateNodeData(dir); err != nil && err != fuse.ErrNotCached {
+		log.Printf("error invalidating %s: %s", dirPath, err)
+	}
+	if err := w.inv.InvalidateNodeAttr(dir); err != nil && err != fuse.ErrNotCached {
+		log.Printf("error invalidating %s: %s", dirPath, err)
+	}
+}
@@ -0,0 +1,755 @@
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+/*
+  workspaces/ is a scratch area where you can edit files with normal tools
+  and turn the result into a commit (only with -workspaces):
+
+  $ mkdir workspaces/fix-typo            # starts out as a copy of HEAD
+  $ ln -sf ../../commits/ab/abcd/<hash> workspaces/fix-typo/.base   # optional: start from another commit
+  $ vim workspaces/fix-typo/README.md
+  $ echo "Fix typo" > workspaces/fix-typo/.commit
+
+  Writing to .commit creates a commit with your changes whose parent is
+  .base, and then .base moves to the new commit. Until then the changes only
+  live in memory. No branches get updated, use branches/ for that.
+*/
+
+type Workspaces struct {
+	repo   *git.Repository
+	lock   sync.Mutex
+	byName map[string]*workspace
+}
+
+type workspace struct {
+	repo *git.Repository
+	lock sync.Mutex
+	/* the commit we started from */
+	base plumbing.Hash
+	/* everything that's different from base, by path */
+	changes map[string]*wsEntry
+	/* what's been written to .commit so far */
+	message []byte
+}
+
+type wsEntry struct {
+	deleted bool
+	dir     bool
+	/* a dir that was deleted and created again, so base doesn't show through */
+	opaque  bool
+	mode    filemode.FileMode
+	content []byte
+}
+
+func newWorkspaces(repo *git.Repository) *Workspaces {
+	return &Workspaces{repo: repo, byName: make(map[string]*workspace)}
+}
+
+type WorkspacesDir struct {
+	workspaces *Workspaces
+}
+
+type WorkspaceTree struct {
+	ws   *workspace
+	name string
+	path string
+}
+
+type WorkspaceFile struct {
+	ws   *workspace
+	name string
+	path string
+}
+
+type WorkspaceCommitFile struct {
+	ws   *workspace
+	name string
+}
+
+func (f *WorkspacesDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o755
+	a.Mtime = time.Unix(0, 0)
+	a.Ctime = time.Unix(0, 0)
+	a.Inode = inode("/workspaces")
+	return nil
+}
+
+func (f *WorkspacesDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	f.workspaces.lock.Lock()
+	defer f.workspaces.lock.Unlock()
+	entries := []fuse.Dirent{}
+	for name := range f.workspaces.byName {
+		entries = append(entries, fuse.Dirent{Name: name, Type: fuse.DT_Dir})
+	}
+	return entries, nil
+}
+
+func (f *WorkspacesDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	f.workspaces.lock.Lock()
+	defer f.workspaces.lock.Unlock()
+	ws, ok := f.workspaces.byName[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return &WorkspaceTree{ws: ws, name: name, path: ""}, nil
+}
+
+func (f *WorkspacesDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	head, err := f.workspaces.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	f.workspaces.lock.Lock()
+	defer f.workspaces.lock.Unlock()
+	if _, ok := f.workspaces.byName[req.Name]; ok {
+		return nil, fuse.EEXIST
+	}
+	ws := &workspace{repo: f.workspaces.repo, base: head.Hash(), changes: make(map[string]*wsEntry)}
+	f.workspaces.byName[req.Name] = ws
+	return &WorkspaceTree{ws: ws, name: req.Name, path: ""}, nil
+}
+
+/* rm -r workspaces/<name> throws away the workspace and any uncommitted changes */
+func (f *WorkspacesDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	f.workspaces.lock.Lock()
+	defer f.workspaces.lock.Unlock()
+	if _, ok := f.workspaces.byName[req.Name]; !ok {
+		return fuse.ENOENT
+	}
+	delete(f.workspaces.byName, req.Name)
+	return nil
+}
+
+func (t *WorkspaceTree) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o755
+	a.Inode = inode("/workspaces/" + t.name + "/" + t.path)
+	return nil
+}
+
+func (t *WorkspaceTree) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	children, err := t.ws.list(t.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fuse.Dirent
+	if t.path == "" {
+		entries = append(entries, fuse.Dirent{Name: ".base", Type: fuse.DT_Link})
+		entries = append(entries, fuse.Dirent{Name: ".commit", Type: fuse.DT_File})
+	}
+	for _, child := range children {
+		d := fuse.Dirent{Name: child.Name}
+		switch child.Mode {
+		case filemode.Dir:
+			d.Type = fuse.DT_Dir
+		case filemode.Symlink:
+			d.Type = fuse.DT_Link
+		default:
+			d.Type = fuse.DT_File
+		}
+		entries = append(entries, d)
+	}
+	return entries, nil
+}
+
+func (t *WorkspaceTree) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	if t.path == "" && name == ".base" {
+		return &SymLink{"../../" + commitPath(t.ws.base.String()), "/workspaces/" + t.name + "/.base"}, nil
+	}
+	if t.path == "" && name == ".commit" {
+		return &WorkspaceCommitFile{ws: t.ws, name: t.name}, nil
+	}
+	return t.ws.node(t.name, path.Join(t.path, name))
+}
+
+func (t *WorkspaceTree) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	p := path.Join(t.path, req.Name)
+	mode := filemode.Regular
+	if req.Mode&0o111 != 0 {
+		mode = filemode.Executable
+	}
+	t.ws.changes[p] = &wsEntry{mode: mode, content: []byte{}}
+	f := &WorkspaceFile{ws: t.ws, name: t.name, path: p}
+	return f, f, nil
+}
+
+func (t *WorkspaceTree) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	p := path.Join(t.path, req.Name)
+	if _, err := t.ws.get(p); err == nil {
+		return nil, fuse.EEXIST
+	}
+	_, wasDeleted := t.ws.changes[p]
+	t.ws.changes[p] = &wsEntry{dir: true, opaque: wasDeleted, mode: filemode.Dir}
+	return &WorkspaceTree{ws: t.ws, name: t.name, path: p}, nil
+}
+
+func (t *WorkspaceTree) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	if t.path == "" && req.NewName == ".base" {
+		if err := t.ws.rebase(req.Target); err != nil {
+			return nil, err
+		}
+		return &SymLink{"../../" + commitPath(t.ws.base.String()), "/workspaces/" + t.name + "/.base"}, nil
+	}
+	p := path.Join(t.path, req.NewName)
+	t.ws.changes[p] = &wsEntry{mode: filemode.Symlink, content: []byte(req.Target)}
+	return &SymLink{req.Target, "/workspaces/" + t.name + "/" + p}, nil
+}
+
+func (t *WorkspaceTree) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	if t.path == "" && (req.Name == ".base" || req.Name == ".commit") {
+		/* `ln -sf` removes .base before making the new one, that's fine */
+		return nil
+	}
+	p := path.Join(t.path, req.Name)
+	if _, err := t.ws.get(p); err != nil {
+		return err
+	}
+	if req.Dir {
+		children, err := t.ws.list(p)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	t.ws.remove(p)
+	return nil
+}
+
+func (t *WorkspaceTree) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	target, ok := newDir.(*WorkspaceTree)
+	if !ok || target.ws != t.ws {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	t.ws.lock.Lock()
+	defer t.ws.lock.Unlock()
+	from := path.Join(t.path, req.OldName)
+	prev, changed := t.ws.changes[from]
+	entry, err := t.ws.copyOnWrite(from)
+	if err != nil {
+		return err
+	}
+	/* `ln -sf` makes a temporary symlink and then renames it to .base, it's not a change */
+	if target.path == "" && req.NewName == ".base" {
+		if entry.mode != filemode.Symlink {
+			if !changed {
+				delete(t.ws.changes, from)
+			}
+			return fuse.Errno(syscall.EINVAL)
+		}
+		delete(t.ws.changes, from)
+		if err := t.ws.rebase(string(entry.content)); err != nil {
+			if changed {
+				t.ws.changes[from] = prev
+			}
+			return err
+		}
+		return nil
+	}
+	t.ws.remove(from)
+	t.ws.changes[path.Join(target.path, req.NewName)] = entry
+	return nil
+}
+
+func (f *WorkspaceFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	entry, err := f.ws.get(f.path)
+	if err != nil {
+		return err
+	}
+	size := uint64(len(entry.content))
+	if entry.content == nil {
+		obj, err := f.ws.repo.Storer.EncodedObject(plumbing.BlobObject, entry.hash)
+		if err != nil {
+			return err
+		}
+		size = uint64(obj.Size())
+	}
+	a.Mode = 0o644
+	if entry.mode == filemode.Executable {
+		a.Mode = 0o755
+	}
+	a.Size = size
+	a.Inode = inode("/workspaces/" + f.name + "/" + f.path)
+	return nil
+}
+
+func (f *WorkspaceFile) ReadAll(ctx context.Context) ([]byte, error) {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	entry, err := f.ws.get(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if entry.content != nil {
+		return append([]byte{}, entry.content...), nil
+	}
+	return readBlob(f.ws.repo, entry.hash)
+}
+
+func (f *WorkspaceFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	entry, err := f.ws.copyOnWrite(f.path)
+	if err != nil {
+		return err
+	}
+	entry.content = writeAt(entry.content, req.Offset, req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *WorkspaceFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if !req.Valid.Size() && !req.Valid.Mode() {
+		return nil
+	}
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	entry, err := f.ws.copyOnWrite(f.path)
+	if err != nil {
+		return err
+	}
+	if req.Valid.Size() {
+		entry.content = truncate(entry.content, req.Size)
+	}
+	if req.Valid.Mode() {
+		/* git only knows about executable or not */
+		if req.Mode&0o111 != 0 {
+			entry.mode = filemode.Executable
+		} else {
+			entry.mode = filemode.Regular
+		}
+	}
+	return nil
+}
+
+func (f *WorkspaceCommitFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	a.Mode = 0o644
+	a.Size = uint64(len(f.ws.message))
+	a.Inode = inode("/workspaces/" + f.name + "/.commit")
+	return nil
+}
+
+func (f *WorkspaceCommitFile) ReadAll(ctx context.Context) ([]byte, error) {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	return append([]byte{}, f.ws.message...), nil
+}
+
+func (f *WorkspaceCommitFile) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	f.ws.message = writeAt(f.ws.message, req.Offset, req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+func (f *WorkspaceCommitFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		f.ws.lock.Lock()
+		defer f.ws.lock.Unlock()
+		f.ws.message = truncate(f.ws.message, req.Size)
+	}
+	return nil
+}
+
+/* the commit happens when whoever wrote the message closes the file */
+func (f *WorkspaceCommitFile) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	f.ws.lock.Lock()
+	defer f.ws.lock.Unlock()
+	if strings.TrimSpace(string(f.ws.message)) == "" {
+		return nil
+	}
+	hash, err := f.ws.commit(string(f.ws.message))
+	f.ws.message = nil
+	if err != nil {
+		log.Printf("error: can't commit workspace %s: %v", f.name, err)
+		return err
+	}
+	log.Printf("committed workspace %s as %s", f.name, hash)
+	return nil
+}
+
+func writeAt(buf []byte, offset int64, data []byte) []byte {
+	end := int(offset) + len(data)
+	if end > len(buf) {
+		buf = append(buf, make([]byte, end-len(buf))...)
+	}
+	copy(buf[offset:], data)
+	return buf
+}
+
+func truncate(buf []byte, size uint64) []byte {
+	if int(size) <= len(buf) {
+		return buf[:size]
+	}
+	return append(buf, make([]byte, int(size)-len(buf))...)
+}
+
+/*
+  The rest is the workspace itself. All of these expect ws.lock to be held.
+*/
+
+/* what's at a path, either from our changes (content != nil) or from base */
+type wsStat struct {
+	dir     bool
+	mode    filemode.FileMode
+	hash    plumbing.Hash
+	content []byte
+}
+
+func parentPath(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+/* false if p or one of its parents got deleted, so base's version of p is gone */
+func (ws *workspace) baseVisible(p string) bool {
+	for dir := p; dir != ""; dir = parentPath(dir) {
+		if e, ok := ws.changes[dir]; ok && (e.deleted || e.opaque) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ws *workspace) baseTree() (*object.Tree, error) {
+	commit, err := ws.repo.CommitObject(ws.base)
+	if err != nil {
+		return nil, err
+	}
+	return commit.Tree()
+}
+
+func (ws *workspace) get(p string) (*wsStat, error) {
+	if p == "" {
+		return &wsStat{dir: true, mode: filemode.Dir}, nil
+	}
+	if e, ok := ws.changes[p]; ok {
+		if e.deleted {
+			return nil, fuse.ENOENT
+		}
+		content := e.content
+		if content == nil && !e.dir {
+			content = []byte{}
+		}
+		return &wsStat{dir: e.dir, mode: e.mode, content: content}, nil
+	}
+	if !ws.baseVisible(parentPath(p)) {
+		return nil, fuse.ENOENT
+	}
+	tree, err := ws.baseTree()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := tree.FindEntry(p)
+	if err != nil {
+		return nil, fuse.ENOENT
+	}
+	return &wsStat{dir: entry.Mode == filemode.Dir, mode: entry.Mode, hash: entry.Hash}, nil
+}
+
+func (ws *workspace) node(name string, p string) (fs.Node, error) {
+	stat, err := ws.get(p)
+	if err != nil {
+		return nil, err
+	}
+	switch stat.mode {
+	case filemode.Dir:
+		return &WorkspaceTree{ws: ws, name: name, path: p}, nil
+	case filemode.Regular, filemode.Executable:
+		return &WorkspaceFile{ws: ws, name: name, path: p}, nil
+	case filemode.Symlink:
+		if stat.content != nil {
+			return &SymLink{string(stat.content), "/workspaces/" + name + "/" + p}, nil
+		}
+		content, err := readBlob(ws.repo, stat.hash)
+		if err != nil {
+			return nil, err
+		}
+		return &SymLink{string(content), "/workspaces/" + name + "/" + p}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+/* the merged view of base + our changes, as tree entries */
+func (ws *workspace) list(p string) ([]object.TreeEntry, error) {
+	byName := make(map[string]object.TreeEntry)
+	if ws.baseVisible(p) {
+		tree, err := ws.baseTree()
+		if err != nil {
+			return nil, err
+		}
+		if p != "" {
+			tree, err = tree.Tree(p)
+		}
+		if err == nil {
+			for _, entry := range tree.Entries {
+				if entry.Mode != filemode.Submodule {
+					byName[entry.Name] = entry
+				}
+			}
+		}
+	}
+	for changed, e := range ws.changes {
+		if parentPath(changed) != p {
+			continue
+		}
+		name := path.Base(changed)
+		if e.deleted {
+			delete(byName, name)
+		} else {
+			byName[name] = object.TreeEntry{Name: name, Mode: e.mode}
+		}
+	}
+	var entries []object.TreeEntry
+	for _, entry := range byName {
+		entries = append(entries, entry)
+	}
+	sortTreeEntries(entries)
+	return entries, nil
+}
+
+/* make sure the file at p is in ws.changes (with its contents) so we can modify it */
+func (ws *workspace) copyOnWrite(p string) (*wsEntry, error) {
+	if e, ok := ws.changes[p]; ok && !e.deleted && !e.dir {
+		if e.content == nil {
+			e.content = []byte{}
+		}
+		return e, nil
+	}
+	stat, err := ws.get(p)
+	if err != nil {
+		return nil, err
+	}
+	if stat.dir {
+		/* moving whole directories around isn't supported, mv will copy instead */
+		return nil, fuse.Errno(syscall.EXDEV)
+	}
+	content, err := readBlob(ws.repo, stat.hash)
+	if err != nil {
+		return nil, err
+	}
+	e := &wsEntry{mode: stat.mode, content: content}
+	ws.changes[p] = e
+	return e, nil
+}
+
+func (ws *workspace) remove(p string) {
+	for changed := range ws.changes {
+		if strings.HasPrefix(changed, p+"/") {
+			delete(ws.changes, changed)
+		}
+	}
+	/* if it was never in the base commit, there's nothing to hide */
+	if !ws.inBase(p) {
+		delete(ws.changes, p)
+		return
+	}
+	ws.changes[p] = &wsEntry{deleted: true}
+}
+
+/* whether the base commit has something at `p` that we'd see without the changes */
+func (ws *workspace) inBase(p string) bool {
+	if !ws.baseVisible(parentPath(p)) {
+		return false
+	}
+	tree, err := ws.baseTree()
+	if err != nil {
+		return true
+	}
+	_, err = tree.FindEntry(p)
+	return err == nil
+}
+
+/* start over from a different commit, as long as there aren't any changes to lose */
+func (ws *workspace) rebase(target string) error {
+	hash, err := commitFromLinkTarget(ws.repo, target)
+	if err != nil {
+		return err
+	}
+	if len(ws.changes) > 0 {
+		log.Printf("can't change .base: the workspace has uncommitted changes")
+		return fuse.Errno(syscall.EBUSY)
+	}
+	ws.base = hash
+	return nil
+}
+
+func (ws *workspace) commit(message string) (plumbing.Hash, error) {
+	base, err := ws.repo.CommitObject(ws.base)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	treeHash, _, err := ws.writeTree("")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if treeHash == base.TreeHash {
+		return plumbing.ZeroHash, fmt.Errorf("nothing to commit: %w", fuse.Errno(syscall.EINVAL))
+	}
+	sig, err := signature(ws.repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hash, err := writeCommit(ws.repo, &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      message,
+		TreeHash:     treeHash,
+		ParentHashes: []plumbing.Hash{ws.base},
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	ws.base = hash
+	ws.changes = make(map[string]*wsEntry)
+	return hash, nil
+}
+
+/* returns false if the tree is empty, because git doesn't store empty directories */
+func (ws *workspace) writeTree(p string) (plumbing.Hash, bool, error) {
+	if !ws.changedUnder(p) {
+		stat, err := ws.get(p)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		if p != "" {
+			return stat.hash, true, nil
+		}
+		tree, err := ws.baseTree()
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		return tree.Hash, true, nil
+	}
+	children, err := ws.list(p)
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	tree := &object.Tree{}
+	for _, child := range children {
+		childPath := path.Join(p, child.Name)
+		switch child.Mode {
+		case filemode.Dir:
+			hash, ok, err := ws.writeTree(childPath)
+			if err != nil {
+				return plumbing.ZeroHash, false, err
+			}
+			if !ok {
+				continue
+			}
+			child.Hash = hash
+		default:
+			if e, ok := ws.changes[childPath]; ok {
+				hash, err := writeBlob(ws.repo, e.content)
+				if err != nil {
+					return plumbing.ZeroHash, false, err
+				}
+				child.Hash = hash
+			}
+		}
+		tree.Entries = append(tree.Entries, child)
+	}
+	if len(tree.Entries) == 0 {
+		return plumbing.ZeroHash, false, nil
+	}
+	obj := ws.repo.Storer.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	hash, err := ws.repo.Storer.SetEncodedObject(obj)
+	return hash, true, err
+}
+
+func (ws *workspace) changedUnder(p string) bool {
+	for changed := range ws.changes {
+		if p == "" || changed == p || strings.HasPrefix(changed, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func writeBlob(repo *git.Repository, content []byte) (plumbing.Hash, error) {
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+/* git sorts tree entries as if directories had a / at the end */
+func sortTreeEntries(entries []object.TreeEntry) {
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+}
+
+/* the author for new commits, from git config (user.name & user.email) */
+func signature(repo *git.Repository) (object.Signature, error) {
+	cfg, err := repo.ConfigScoped(config.SystemScope)
+	if err != nil {
+		return object.Signature{}, err
+	}
+	name, email := cfg.User.Name, cfg.User.Email
+	if cfg.Author.Name != "" {
+		name, email = cfg.Author.Name, cfg.Author.Email
+	}
+	if name == "" || email == "" {
+		return object.Signature{}, fmt.Errorf("set user.name and user.email in your git config to make commits")
+	}
+	return object.Signature{Name: name, Email: email, When: time.Now()}, nil
+}
@@ -0,0 +1,120 @@
+package fuse
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+/* an in-memory repo with one commit for each set of files, on main */
+func testRepo(t *testing.T, commits ...map[string]string) (*git.Repository, []plumbing.Hash) {
+	fs := memfs.New()
+	repo, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []plumbing.Hash
+	for i, files := range commits {
+		for name, content := range files {
+			if err := util.WriteFile(fs, name, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tree.Add(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sig := &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(int64(i), 0)}
+		hash, err := tree.Commit("commit", &git.CommitOptions{Author: sig})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return repo, hashes
+}
+
+func testWorkspace(t *testing.T, repo *git.Repository) *WorkspaceTree {
+	dir := &WorkspacesDir{workspaces: newWorkspaces(repo)}
+	node, err := dir.Mkdir(context.Background(), &fuse.MkdirRequest{Name: "w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node.(*WorkspaceTree)
+}
+
+/* what `ln -sf <target> .base` does: symlink a temporary name, rename it over .base, and clean up */
+func lnSf(t *testing.T, root *WorkspaceTree, target string) error {
+	ctx := context.Background()
+	if _, err := root.Symlink(ctx, &fuse.SymlinkRequest{NewName: ".base.tmp", Target: target}); err != nil {
+		t.Fatal(err)
+	}
+	err := root.Rename(ctx, &fuse.RenameRequest{OldName: ".base.tmp", NewName: ".base"}, root)
+	if err != nil {
+		root.Remove(ctx, &fuse.RemoveRequest{Name: ".base.tmp"})
+	}
+	return err
+}
+
+func TestWorkspaceRebase(t *testing.T) {
+	repo, hashes := testRepo(t, map[string]string{"a.txt": "a\n"}, map[string]string{"b.txt": "b\n"})
+	root := testWorkspace(t, repo)
+	if err := lnSf(t, root, "../../"+commitPath(hashes[0].String())); err != nil {
+		t.Fatalf("ln -sf: %v", err)
+	}
+	if root.ws.base != hashes[0] || len(root.ws.changes) != 0 {
+		t.Errorf("base %s, changes %v", root.ws.base, root.ws.changes)
+	}
+	/* and again, so the first one didn't leave anything behind */
+	if err := lnSf(t, root, "../../"+commitPath(hashes[1].String())); err != nil {
+		t.Fatalf("second ln -sf: %v", err)
+	}
+	if root.ws.base != hashes[1] {
+		t.Errorf("base %s, want %s", root.ws.base, hashes[1])
+	}
+	/* a failed ln -sf doesn't leave the workspace busy either */
+	if err := lnSf(t, root, "not-a-commit"); err == nil {
+		t.Errorf("rebased onto a bad target")
+	}
+	if len(root.ws.changes) != 0 {
+		t.Errorf("changes after a failed ln -sf: %v", root.ws.changes)
+	}
+}
+
+func TestWorkspaceRemove(t *testing.T) {
+	repo, hashes := testRepo(t, map[string]string{"a.txt": "a\n"})
+	root := testWorkspace(t, repo)
+	ctx := context.Background()
+	/* something new and then removed isn't a change */
+	if _, _, err := root.Create(ctx, &fuse.CreateRequest{Name: "new.txt"}, &fuse.CreateResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "new.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(root.ws.changes) != 0 {
+		t.Errorf("changes: %v", root.ws.changes)
+	}
+	/* but removing something from the base commit is */
+	if err := root.Remove(ctx, &fuse.RemoveRequest{Name: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := root.ws.changes["a.txt"]; e == nil || !e.deleted {
+		t.Errorf("a.txt: %+v", e)
+	}
+	if err := lnSf(t, root, "../../"+commitPath(hashes[0].String())); err != fuse.Errno(syscall.EBUSY) {
+		t.Errorf("rebasing with changes: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package fuse2nfs
+
+import (
+	"context"
+	"os"
+	"sort"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+)
+
+/* a small read-only filesystem for the protocol tests */
+
+type fakeFS struct {
+	root fakeDir
+}
+
+func (f fakeFS) Root() (fs.Node, error) {
+	return f.root, nil
+}
+
+type fakeDir map[string]fs.Node
+
+func (d fakeDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0o555
+	return nil
+}
+
+func (d fakeDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if node, ok := d[name]; ok {
+		return node, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d fakeDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	for name := range d {
+		entries = append(entries, fuse.Dirent{Name: name})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+type fakeFile string
+
+func (f fakeFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	a.Size = uint64(len(f))
+	return nil
+}
+
+func (f fakeFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return []byte(f), nil
+}
+
+/*
+like archives/: made while you read it, so it has its own Open, and the size
+is 0 until someone asks for it
+*/
+type fakeStream struct {
+	content string
+	/* how many handles are open, and how many were ever opened */
+	open, opened *int
+}
+
+func (f fakeStream) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	return nil
+}
+
+func (f fakeStream) Size(ctx context.Context) (uint64, error) {
+	return uint64(len(f.content)), nil
+}
+
+func (f fakeStream) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	*f.open++
+	*f.opened++
+	return f, nil
+}
+
+func (f fakeStream) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	*f.open--
+	return nil
+}
+
+func (f fakeStream) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	if req.Offset >= int64(len(f.content)) {
+		return nil
+	}
+	/* short reads, like an archive that's still being made */
+	end := req.Offset + 3
+	if end > int64(len(f.content)) {
+		end = int64(len(f.content))
+	}
+	resp.Data = []byte(f.content[req.Offset:end])
+	return nil
+}
+
+type fakeLink string
+
+func (l fakeLink) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeSymlink | 0o777
+	return nil
+}
+
+func (l fakeLink) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return string(l), nil
+}
+
+/* README.md, archive.tar (a fakeStream), d/b.go, link -> d/b.go and up -> .. */
+func newFakeFS() fakeFS {
+	return fakeFS{fakeDir{
+		"README.md":   fakeFile("hello\n"),
+		"archive.tar": fakeStream{"not really a tar\n", new(int), new(int)},
+		"d":           fakeDir{"b.go": fakeFile("package b\n")},
+		"link":        fakeLink("d/b.go"),
+		"up":          fakeLink(".."),
+	}}
+}
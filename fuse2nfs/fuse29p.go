@@ -0,0 +1,653 @@
+package fuse2nfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+	billy "github.com/go-git/go-billy/v5"
+)
+
+/*
+  A 9P2000.L server, for VMs and containers that have `mount -t 9p` but not
+  FUSE. Like NFS, 9P works with paths, so this is built on FuseNFSfs.
+
+  It only does the parts of the protocol that Linux uses for a read-only
+  filesystem (plus symlink/unlink/rename, for -writable-refs). The client
+  follows symlinks itself. Requests on a connection are handled one at a
+  time, which keeps Tflush simple.
+
+  The protocol is described at
+  https://github.com/chaos/diod/blob/master/protocol.md
+*/
+
+const (
+	p9Rlerror    = 7
+	p9Tstatfs    = 8
+	p9Tlopen     = 12
+	p9Tlcreate   = 14
+	p9Tsymlink   = 16
+	p9Tmknod     = 18
+	p9Trename    = 20
+	p9Treadlink  = 22
+	p9Tgetattr   = 24
+	p9Tsetattr   = 26
+	p9Txattrwalk = 30
+	p9Treaddir   = 40
+	p9Tfsync     = 50
+	p9Tlink      = 70
+	p9Tmkdir     = 72
+	p9Trenameat  = 74
+	p9Tunlinkat  = 76
+	p9Tversion   = 100
+	p9Tauth      = 102
+	p9Tattach    = 104
+	p9Tflush     = 108
+	p9Twalk      = 110
+	p9Tread      = 116
+	p9Twrite     = 118
+	p9Tclunk     = 120
+	p9Tremove    = 122
+)
+
+const p9MaxMsize = 1 << 20
+
+/* 9P2000.L always uses Linux's errno numbers, even if we're on a Mac */
+type p9Errno uint32
+
+const (
+	p9EPERM      p9Errno = 1
+	p9ENOENT     p9Errno = 2
+	p9EIO        p9Errno = 5
+	p9EBADF      p9Errno = 9
+	p9EINVAL     p9Errno = 22
+	p9EROFS      p9Errno = 30
+	p9ENOSYS     p9Errno = 38
+	p9EOPNOTSUPP p9Errno = 95
+)
+
+func (e p9Errno) Error() string {
+	return fmt.Sprintf("9p errno %d", uint32(e))
+}
+
+var linuxErrnos = map[syscall.Errno]p9Errno{
+	syscall.EPERM:     1,
+	syscall.ENOENT:    2,
+	syscall.EIO:       5,
+	syscall.EBADF:     9,
+	syscall.EACCES:    13,
+	syscall.EBUSY:     16,
+	syscall.EEXIST:    17,
+	syscall.ENOTDIR:   20,
+	syscall.EISDIR:    21,
+	syscall.EINVAL:    22,
+	syscall.EROFS:     30,
+	syscall.ENOSYS:    38,
+	syscall.ENOTEMPTY: 39,
+	syscall.ELOOP:     40,
+}
+
+func toP9Errno(err error) p9Errno {
+	var e p9Errno
+	if errors.As(err, &e) {
+		return e
+	}
+	var errno syscall.Errno
+	if errors.As(toOSError(err), &errno) {
+		if e, ok := linuxErrnos[errno]; ok {
+			return e
+		}
+	}
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return p9ENOENT
+	case errors.Is(err, os.ErrPermission):
+		return p9EPERM
+	}
+	return p9EIO
+}
+
+type NinePServer struct {
+	fs fs.FS
+	/* whether to pass symlink/rename/unlink on to the filesystem (-writable-refs) */
+	writable bool
+}
+
+func Fuse29P(fs fs.FS, writable bool) *NinePServer {
+	return &NinePServer{fs: fs, writable: writable}
+}
+
+func (s *NinePServer) Serve(listener net.Listener) error {
+	/* shared between connections, so they share the node cache */
+	nfs := newFuseNFSfs(s.fs, Options{})
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		c := &p9Conn{conn: conn, nfs: nfs, writable: s.writable, msize: p9MaxMsize, fids: make(map[uint32]*p9Fid)}
+		go c.serve()
+	}
+}
+
+type p9Conn struct {
+	conn     net.Conn
+	nfs      *FuseNFSfs
+	writable bool
+	msize    uint32
+	fids     map[uint32]*p9Fid
+}
+
+type p9Fid struct {
+	path []string
+	/* after Tlopen */
+	file billy.File
+	dir  []os.FileInfo
+}
+
+func (f *p9Fid) join() string {
+	return strings.Join(f.path, "/")
+}
+
+func (f *p9Fid) close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+}
+
+func (c *p9Conn) serve() {
+	defer c.conn.Close()
+	defer c.clunkAll()
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c.conn, size[:]); err != nil {
+			return
+		}
+		n := binary.LittleEndian.Uint32(size[:])
+		if n < 7 || n > c.msize {
+			log.Printf("9P: bad message size %d", n)
+			return
+		}
+		msg := make([]byte, n-4)
+		if _, err := io.ReadFull(c.conn, msg); err != nil {
+			return
+		}
+		typ, tag := msg[0], binary.LittleEndian.Uint16(msg[1:3])
+		rtyp, body, err := c.handle(typ, &p9Decoder{b: msg[3:]})
+		if err != nil {
+			rtyp, body = p9Rlerror, p9u32(nil, uint32(toP9Errno(err)))
+		}
+		reply := p9u32(nil, uint32(7+len(body)))
+		reply = append(reply, rtyp)
+		reply = p9u16(reply, tag)
+		if _, err := c.conn.Write(append(reply, body...)); err != nil {
+			return
+		}
+	}
+}
+
+/* returns the reply's type (always typ+1) and body */
+func (c *p9Conn) handle(typ uint8, d *p9Decoder) (uint8, []byte, error) {
+	if typ == p9Tversion {
+		return c.version(d)
+	}
+	var body []byte
+	var err error
+	switch typ {
+	case p9Tattach:
+		body, err = c.attach(d)
+	case p9Twalk:
+		body, err = c.walk(d)
+	case p9Tgetattr:
+		body, err = c.getattr(d)
+	case p9Tlopen:
+		body, err = c.lopen(d)
+	case p9Tread:
+		body, err = c.read(d)
+	case p9Treaddir:
+		body, err = c.readdir(d)
+	case p9Treadlink:
+		body, err = c.readlink(d)
+	case p9Tstatfs:
+		body, err = c.statfs(d)
+	case p9Tclunk:
+		_, err = c.fid(d, true)
+	case p9Tremove:
+		/* always clunks, even if removing fails */
+		var f *p9Fid
+		if f, err = c.fid(d, true); err == nil && !c.writable {
+			err = p9EROFS
+		} else if err == nil {
+			err = c.nfs.Remove(f.join())
+		}
+	case p9Tsymlink, p9Trename, p9Trenameat, p9Tunlinkat:
+		if !c.writable {
+			err = p9EROFS
+			break
+		}
+		switch typ {
+		case p9Tsymlink:
+			body, err = c.symlink(d)
+		case p9Trename:
+			err = c.rename(d)
+		case p9Trenameat:
+			err = c.renameat(d)
+		case p9Tunlinkat:
+			err = c.unlinkat(d)
+		}
+	case p9Tflush, p9Tfsync:
+		/* nothing to do */
+	case p9Tauth:
+		err = p9EOPNOTSUPP
+	case p9Txattrwalk:
+		err = p9EOPNOTSUPP
+	case p9Tlcreate, p9Tmknod, p9Tmkdir, p9Tlink, p9Twrite, p9Tsetattr:
+		err = p9EROFS
+	default:
+		err = p9ENOSYS
+	}
+	if err == nil && d.err {
+		err = p9EINVAL
+	}
+	return typ + 1, body, err
+}
+
+func (c *p9Conn) version(d *p9Decoder) (uint8, []byte, error) {
+	msize, version := d.u32(), d.str()
+	if msize < 4096 {
+		return 0, nil, p9EINVAL
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	/* a new session, so forget everything */
+	c.clunkAll()
+	if version != "9P2000.L" {
+		version = "unknown"
+	}
+	return p9Tversion + 1, p9str(p9u32(nil, c.msize), version), nil
+}
+
+/* the fid at the start of `d` (and forgets it if `clunk`) */
+func (c *p9Conn) fid(d *p9Decoder, clunk bool) (*p9Fid, error) {
+	id := d.u32()
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, p9EBADF
+	}
+	if clunk {
+		f.close()
+		delete(c.fids, id)
+	}
+	return f, nil
+}
+
+func (c *p9Conn) clunkAll() {
+	for _, f := range c.fids {
+		f.close()
+	}
+	c.fids = make(map[uint32]*p9Fid)
+}
+
+func (c *p9Conn) attach(d *p9Decoder) ([]byte, error) {
+	id := d.u32()
+	if _, ok := c.fids[id]; ok {
+		return nil, p9EBADF
+	}
+	d.u32() /* afid */
+	d.str() /* uname */
+	d.str() /* aname */
+	d.u32() /* n_uname */
+	if d.err {
+		return nil, p9EINVAL
+	}
+	info, err := c.nfs.Lstat("")
+	if err != nil {
+		return nil, err
+	}
+	c.fids[id] = &p9Fid{}
+	return p9qid(nil, info), nil
+}
+
+func (c *p9Conn) walk(d *p9Decoder) ([]byte, error) {
+	id := d.u32()
+	f, ok := c.fids[id]
+	if !ok {
+		return nil, p9EBADF
+	}
+	newID := d.u32()
+	/* newfid can be the same as fid, but not some other fid that's in use */
+	if _, ok := c.fids[newID]; ok && newID != id {
+		return nil, p9EBADF
+	}
+	names := make([]string, d.u16())
+	for i := range names {
+		names[i] = d.str()
+	}
+	/* don't make a fid from half a message */
+	if d.err {
+		return nil, p9EINVAL
+	}
+	path := append([]string{}, f.path...)
+	var qids []os.FileInfo
+	for i, name := range names {
+		if name == ".." {
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+		} else {
+			path = append(path, name)
+		}
+		info, err := c.nfs.Lstat(strings.Join(path, "/"))
+		if err != nil {
+			/* only an error if we couldn't walk anywhere */
+			if i == 0 {
+				return nil, err
+			}
+			break
+		}
+		qids = append(qids, info)
+	}
+	if len(qids) == len(names) {
+		c.fids[newID] = &p9Fid{path: path}
+	}
+	body := p9u16(nil, uint16(len(qids)))
+	for _, info := range qids {
+		body = p9qid(body, info)
+	}
+	return body, nil
+}
+
+func (c *p9Conn) getattr(d *p9Decoder) ([]byte, error) {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.nfs.Lstat(f.join())
+	if err != nil {
+		return nil, err
+	}
+	attr := fuseAttr(info)
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		mode |= syscall.S_IFDIR
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	nlink := uint64(attr.Nlink)
+	if nlink == 0 {
+		nlink = 1
+	}
+	size := uint64(info.Size())
+	mtime := info.ModTime()
+	body := p9u64(nil, 0x7ff) /* P9_GETATTR_BASIC: everything up to blocks */
+	body = p9qid(body, info)
+	body = p9u32(body, mode)
+	body = p9u32(body, uint32(os.Getuid()))
+	body = p9u32(body, uint32(os.Getgid()))
+	body = p9u64(body, nlink)
+	body = p9u64(body, 0)              /* rdev */
+	body = p9u64(body, size)           /* size */
+	body = p9u64(body, 4096)           /* blksize */
+	body = p9u64(body, (size+511)/512) /* blocks */
+	for i := 0; i < 3; i++ {
+		/* atime, mtime, ctime */
+		body = p9u64(body, uint64(mtime.Unix()))
+		body = p9u64(body, uint64(mtime.Nanosecond()))
+	}
+	/* btime, gen, data_version */
+	return append(body, make([]byte, 8*4)...), nil
+}
+
+func (c *p9Conn) lopen(d *p9Decoder) ([]byte, error) {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return nil, err
+	}
+	if d.u32()&uint32(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, p9EROFS
+	}
+	info, err := c.nfs.Lstat(f.join())
+	if err != nil {
+		return nil, err
+	}
+	f.close()
+	if !info.IsDir() {
+		if f.file, err = c.nfs.Open(f.join()); err != nil {
+			return nil, err
+		}
+	}
+	/* the biggest read that fits in a message */
+	return p9u32(p9qid(nil, info), c.msize-24), nil
+}
+
+func (c *p9Conn) read(d *p9Decoder) ([]byte, error) {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return nil, err
+	}
+	offset, count := d.u64(), d.u32()
+	if f.file == nil {
+		return nil, p9EBADF
+	}
+	if count > c.msize-11 {
+		count = c.msize - 11
+	}
+	buf := make([]byte, count)
+	n, err := f.file.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return append(p9u32(nil, uint32(n)), buf[:n]...), nil
+}
+
+func (c *p9Conn) readdir(d *p9Decoder) ([]byte, error) {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return nil, err
+	}
+	offset, count := d.u64(), d.u32()
+	/* offset 0 is rewinddir, so read it again in case it changed */
+	if f.dir == nil || offset == 0 {
+		if f.dir, err = c.nfs.ReadDir(f.join()); err != nil {
+			return nil, err
+		}
+	}
+	var entries []byte
+	/* the offset of each entry is where the next one starts */
+	for i := offset; i < uint64(len(f.dir)); i++ {
+		info := f.dir[i]
+		var typ uint8 = 8 /* DT_REG */
+		if info.IsDir() {
+			typ = 4 /* DT_DIR */
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			typ = 10 /* DT_LNK */
+		}
+		entry := p9qid(nil, info)
+		entry = p9u64(entry, i+1)
+		entry = append(entry, typ)
+		entry = p9str(entry, info.Name())
+		if len(entries)+len(entry) > int(count) {
+			break
+		}
+		entries = append(entries, entry...)
+	}
+	return append(p9u32(nil, uint32(len(entries))), entries...), nil
+}
+
+func (c *p9Conn) readlink(d *p9Decoder) ([]byte, error) {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return nil, err
+	}
+	target, err := c.nfs.Readlink(f.join())
+	if err != nil {
+		return nil, err
+	}
+	return p9str(nil, target), nil
+}
+
+func (c *p9Conn) statfs(d *p9Decoder) ([]byte, error) {
+	if _, err := c.fid(d, false); err != nil {
+		return nil, err
+	}
+	body := p9u32(nil, 0x01021997) /* V9FS_MAGIC */
+	body = p9u32(body, 4096)       /* bsize */
+	/* blocks, bfree, bavail, files, ffree, fsid */
+	body = append(body, make([]byte, 8*6)...)
+	return p9u32(body, 255), nil /* namelen */
+}
+
+func (c *p9Conn) symlink(d *p9Decoder) ([]byte, error) {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return nil, err
+	}
+	name, target := d.str(), d.str()
+	d.u32() /* gid */
+	if d.err {
+		return nil, p9EINVAL
+	}
+	link := strings.Join(append(append([]string{}, f.path...), name), "/")
+	if err := c.nfs.Symlink(target, link); err != nil {
+		return nil, err
+	}
+	info, err := c.nfs.Lstat(link)
+	if err != nil {
+		return nil, err
+	}
+	return p9qid(nil, info), nil
+}
+
+func (c *p9Conn) rename(d *p9Decoder) error {
+	f, err := c.fid(d, false)
+	if err != nil {
+		return err
+	}
+	dir, err := c.fid(d, false)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	if d.err {
+		return p9EINVAL
+	}
+	to := strings.Join(append(append([]string{}, dir.path...), name), "/")
+	if err := c.nfs.Rename(f.join(), to); err != nil {
+		return err
+	}
+	f.path = splitParts(to)
+	return nil
+}
+
+func (c *p9Conn) renameat(d *p9Decoder) error {
+	oldDir, err := c.fid(d, false)
+	if err != nil {
+		return err
+	}
+	oldName := d.str()
+	newDir, err := c.fid(d, false)
+	if err != nil {
+		return err
+	}
+	newName := d.str()
+	if d.err {
+		return p9EINVAL
+	}
+	return c.nfs.Rename(oldDir.join()+"/"+oldName, newDir.join()+"/"+newName)
+}
+
+func (c *p9Conn) unlinkat(d *p9Decoder) error {
+	dir, err := c.fid(d, false)
+	if err != nil {
+		return err
+	}
+	name := d.str()
+	if d.err {
+		return p9EINVAL
+	}
+	return c.nfs.Remove(dir.join() + "/" + name)
+}
+
+func fuseAttr(info os.FileInfo) fuse.Attr {
+	if a, ok := info.(FuseAttr); ok {
+		return a.attr
+	}
+	return fuse.Attr{}
+}
+
+/* the qid is how the client tells files apart, like an inode number */
+func p9qid(b []byte, info os.FileInfo) []byte {
+	var typ uint8
+	if info.IsDir() {
+		typ = 0x80 /* QTDIR */
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		typ = 0x02 /* QTSYMLINK */
+	}
+	b = append(b, typ)
+	b = p9u32(b, 0) /* version */
+	return p9u64(b, fuseAttr(info).Inode)
+}
+
+/* encoding & decoding, everything is little endian */
+
+func p9u16(b []byte, v uint16) []byte {
+	return binary.LittleEndian.AppendUint16(b, v)
+}
+
+func p9u32(b []byte, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func p9u64(b []byte, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func p9str(b []byte, s string) []byte {
+	return append(p9u16(b, uint16(len(s))), s...)
+}
+
+type p9Decoder struct {
+	b []byte
+	/* set if the message was too short */
+	err bool
+}
+
+func (d *p9Decoder) next(n int) []byte {
+	if len(d.b) < n {
+		d.err = true
+		d.b = nil
+		return make([]byte, n)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *p9Decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *p9Decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *p9Decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *p9Decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
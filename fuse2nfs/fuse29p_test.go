@@ -0,0 +1,176 @@
+package fuse2nfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+type p9Client struct {
+	t      *testing.T
+	conn   net.Conn
+	server *p9Conn
+}
+
+func new9PClient(t *testing.T, writable bool) *p9Client {
+	client, server := net.Pipe()
+	c := &p9Conn{conn: server, nfs: newFuseNFSfs(newFakeFS(), Options{}), writable: writable, msize: 8192, fids: make(map[uint32]*p9Fid)}
+	go c.serve()
+	t.Cleanup(func() { client.Close() })
+	p := &p9Client{t: t, conn: client, server: c}
+	if typ, body := p.rpc(p9Tversion, p9str(p9u32(nil, 8192), "9P2000.L")); typ != p9Tversion+1 {
+		t.Fatalf("Tversion: %d %v", typ, body)
+	}
+	if err := p.call(p9Tattach, p9u32(p9str(p9str(p9u32(p9u32(nil, 1), ^uint32(0)), "me"), ""), 0)); err != nil {
+		t.Fatalf("Tattach: %v", err)
+	}
+	return p
+}
+
+/* sends a message and returns the reply's type and body */
+func (p *p9Client) rpc(typ uint8, body []byte) (uint8, []byte) {
+	msg := p9u32(nil, uint32(7+len(body)))
+	msg = append(msg, typ)
+	msg = p9u16(msg, 1)
+	if _, err := p.conn.Write(append(msg, body...)); err != nil {
+		p.t.Fatal(err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(p.conn, size[:]); err != nil {
+		p.t.Fatal(err)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(size[:])-4)
+	if _, err := io.ReadFull(p.conn, reply); err != nil {
+		p.t.Fatal(err)
+	}
+	if reply[0] != p9Rlerror && reply[0] != typ+1 {
+		p.t.Fatalf("sent %d, got a %d back", typ, reply[0])
+	}
+	return reply[0], reply[3:]
+}
+
+/* the error from an Rlerror, or nil */
+func (p *p9Client) call(typ uint8, body []byte) error {
+	rtyp, reply := p.rpc(typ, body)
+	if rtyp == p9Rlerror {
+		return p9Errno(binary.LittleEndian.Uint32(reply))
+	}
+	return nil
+}
+
+func (p *p9Client) walk(fid, newFid uint32, names ...string) error {
+	body := p9u16(p9u32(p9u32(nil, fid), newFid), uint16(len(names)))
+	for _, name := range names {
+		body = p9str(body, name)
+	}
+	return p.call(p9Twalk, body)
+}
+
+func TestP9Read(t *testing.T) {
+	p := new9PClient(t, false)
+	if err := p.walk(1, 2, "d", "b.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.call(p9Tlopen, p9u32(p9u32(nil, 2), 0)); err != nil {
+		t.Fatal(err)
+	}
+	typ, body := p.rpc(p9Tread, p9u32(p9u64(p9u32(nil, 2), 2), 100))
+	if typ == p9Rlerror {
+		t.Fatalf("Tread: %v", body)
+	}
+	d := &p9Decoder{b: body}
+	if got := string(d.next(int(d.u32()))); got != "ckage b\n" {
+		t.Errorf("read %q", got)
+	}
+	if err := p.call(p9Tclunk, p9u32(nil, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.call(p9Tread, p9u32(p9u64(p9u32(nil, 2), 0), 100)); err != p9EBADF {
+		t.Errorf("reading a clunked fid: %v", err)
+	}
+}
+
+func TestP9Walk(t *testing.T) {
+	p := new9PClient(t, false)
+	if err := p.walk(1, 2, "missing"); err != p9ENOENT {
+		t.Errorf("walking to a missing file: %v", err)
+	}
+	/* a partial walk doesn't make the new fid */
+	if err := p.walk(1, 2, "d", "missing"); err != nil {
+		t.Errorf("partial walk: %v", err)
+	}
+	if err := p.call(p9Tclunk, p9u32(nil, 2)); err != p9EBADF {
+		t.Errorf("clunking after a partial walk: %v", err)
+	}
+	if err := p.walk(1, 2, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.walk(1, 2, "README.md"); err != p9EBADF {
+		t.Errorf("walking to a fid that's in use: %v", err)
+	}
+	/* but walking a fid to itself is fine */
+	if err := p.walk(2, 2, "b.go"); err != nil {
+		t.Errorf("walking a fid to itself: %v", err)
+	}
+	if err := p.walk(3, 4); err != p9EBADF {
+		t.Errorf("walking from an unknown fid: %v", err)
+	}
+}
+
+func TestP9ReadOnly(t *testing.T) {
+	p := new9PClient(t, false)
+	for name, msg := range map[string]struct {
+		typ  uint8
+		body []byte
+	}{
+		"Tsymlink":  {p9Tsymlink, p9u32(p9str(p9str(p9u32(nil, 1), "new"), "README.md"), 0)},
+		"Trename":   {p9Trename, p9str(p9u32(p9u32(nil, 1), 1), "new")},
+		"Trenameat": {p9Trenameat, p9str(p9u32(p9str(p9u32(nil, 1), "README.md"), 1), "new")},
+		"Tunlinkat": {p9Tunlinkat, p9u32(p9str(p9u32(nil, 1), "README.md"), 0)},
+		"Tlopen":    {p9Tlopen, p9u32(p9u32(nil, 1), 2)}, /* O_RDWR */
+	} {
+		if err := p.call(msg.typ, msg.body); err != p9EROFS {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := p.walk(1, 2, "README.md"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.call(p9Tremove, p9u32(nil, 2)); err != p9EROFS {
+		t.Errorf("Tremove: %v", err)
+	}
+	/* it's clunked anyway */
+	if err := p.call(p9Tclunk, p9u32(nil, 2)); err != p9EBADF {
+		t.Errorf("Tremove didn't clunk: %v", err)
+	}
+}
+
+func TestP9ShortMessage(t *testing.T) {
+	p := new9PClient(t, false)
+	/* the newfid is cut off, so there shouldn't be a fid 0 afterwards */
+	if err := p.call(p9Twalk, []byte{1, 0, 0, 0, 2}); err != p9EINVAL {
+		t.Errorf("short Twalk: %v", err)
+	}
+	if err := p.call(p9Treadlink, nil); err != p9EBADF {
+		t.Errorf("empty Treadlink: %v", err)
+	}
+	if err := p.call(255, nil); err != p9ENOSYS {
+		t.Errorf("unknown message: %v", err)
+	}
+}
+
+func TestP9Decoder(t *testing.T) {
+	b := p9str(p9u64(p9u32(p9u16(nil, 1), 2), 3), "hi")
+	d := &p9Decoder{b: b}
+	if d.u16() != 1 || d.u32() != 2 || d.u64() != 3 || d.str() != "hi" || d.err {
+		t.Errorf("didn't decode %v", b)
+	}
+	d = &p9Decoder{b: p9u16(nil, 10)}
+	if d.str(); !d.err {
+		t.Errorf("a string longer than the message should be an error")
+	}
+	if d.u32(); !d.err {
+		t.Errorf("reading past the end should stay an error")
+	}
+}
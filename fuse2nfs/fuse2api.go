@@ -0,0 +1,367 @@
+package fuse2nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/anacrolix/fuse/fs"
+)
+
+/*
+  A JSON API, for scripts and dashboards that want to look at the repository
+  without running git. It reads everything from the same folders as the
+  mount, like the HTTP browser (fuse2http.go) does:
+
+  * GET /api/refs                  every branch and tag, and its commit
+  * GET /api/commits/<rev>         a commit: message, author, parents, tree
+  * GET /api/tree/<rev>/<path>     a directory listing
+  * GET /api/blob/<rev>/<path>     a file
+
+  <rev> is a commit hash, a branch or a tag. If it's a hash, the response can
+  never change, so we tell clients to cache it forever. Otherwise they have to
+  check the ETag every time, because branches move. The ETag is the commit's
+  hash, the tree or blob's hash and its path, or (for /api/refs) a hash of the
+  response.
+*/
+
+type FuseAPI struct {
+	nfs *FuseNFSfs
+}
+
+func Fuse2API(fs fs.FS) http.Handler {
+	return &FuseAPI{nfs: newFuseNFSfs(fs, Options{FollowSymlinks: true})}
+}
+
+type apiRefs struct {
+	Branches map[string]string `json:"branches"`
+	Tags     map[string]string `json:"tags"`
+}
+
+type apiSignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+type apiCommit struct {
+	Hash      string       `json:"hash"`
+	Tree      string       `json:"tree"`
+	Parents   []string     `json:"parents"`
+	Author    apiSignature `json:"author"`
+	Committer apiSignature `json:"committer"`
+	Message   string       `json:"message"`
+}
+
+type apiTreeEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"` /* tree, blob or symlink */
+	Hash   string `json:"hash,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+/*
+tree and blob responses don't say which commit they're from, so that they
+only change when the tree or blob (or the path) does
+*/
+type apiTree struct {
+	Path    string         `json:"path"`
+	Hash    string         `json:"hash"`
+	Entries []apiTreeEntry `json:"entries"`
+}
+
+type apiBlob struct {
+	Path     string `json:"path"`
+	Hash     string `json:"hash"`
+	Size     int64  `json:"size"`
+	Encoding string `json:"encoding"` /* utf-8 or base64 */
+	Content  string `json:"content"`
+}
+
+/* for errors we return ourselves, so we know which status code to use */
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Sprintf(format, args...)}
+}
+
+func (h *FuseAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeAPIError(w, &apiError{http.StatusMethodNotAllowed, "only GET is supported"})
+		return
+	}
+	ctx := r.Context()
+	parts := splitParts(r.URL.Path)
+	if len(parts) < 2 || parts[0] != "api" {
+		writeAPIError(w, notFound("no such endpoint: %s", r.URL.Path))
+		return
+	}
+	var (
+		resp interface{}
+		etag string
+		err  error
+	)
+	/* whether the response will never change */
+	immutable := len(parts) > 2 && endsWithHash(parts[2]) && len(parts[2]) == 40
+	switch {
+	case parts[1] == "refs" && len(parts) == 2:
+		resp, err = h.refs(ctx)
+	case parts[1] == "commits" && len(parts) == 3:
+		var commit *apiCommit
+		commit, err = h.commit(ctx, parts[2])
+		if err == nil {
+			resp, etag = commit, commit.Hash
+		}
+	case parts[1] == "tree" && len(parts) >= 3:
+		var tree *apiTree
+		tree, err = h.tree(ctx, parts[2], strings.Join(parts[3:], "/"))
+		if err == nil {
+			resp, etag = tree, fmt.Sprintf("%s-%x", tree.Hash, pathHash(tree.Path))
+		}
+	case parts[1] == "blob" && len(parts) >= 4:
+		var blob *apiBlob
+		blob, err = h.blob(ctx, parts[2], strings.Join(parts[3:], "/"))
+		if err == nil {
+			resp, etag = blob, fmt.Sprintf("%s-%x", blob.Hash, pathHash(blob.Path))
+		}
+	default:
+		err = notFound("no such endpoint: %s", r.URL.Path)
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	body, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	body = append(body, '\n')
+	if etag == "" {
+		sum := sha256.Sum256(body)
+		etag = hex.EncodeToString(sum[:16])
+	}
+	if immutable {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Etag", `"`+etag+`"`)
+	/* takes care of If-None-Match (lists, W/ and *) and HEAD */
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(resp); err != nil {
+		log.Printf("API: %s", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.status
+	} else if os.IsNotExist(toOSError(err)) {
+		status = http.StatusNotFound
+	} else {
+		log.Printf("API: %s", err)
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (h *FuseAPI) refs(ctx context.Context) (*apiRefs, error) {
+	refs := &apiRefs{Branches: make(map[string]string), Tags: make(map[string]string)}
+	for dir, m := range map[string]map[string]string{"branches": refs.Branches, "tags": refs.Tags} {
+		names, err := h.nfs.readDirNames(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			target, err := h.nfs.Readlink(dir + "/" + name)
+			/* like tags/.new */
+			if err != nil || !endsWithHash(target) {
+				continue
+			}
+			m[name] = target[len(target)-40:]
+		}
+	}
+	return refs, nil
+}
+
+/* the commit `rev` is, using branches/ & tags/ */
+func (h *FuseAPI) resolve(ctx context.Context, rev string) (string, error) {
+	if len(rev) == 40 && endsWithHash(rev) {
+		return rev, nil
+	}
+	for _, dir := range []string{"branches", "tags"} {
+		if target, err := h.nfs.Readlink(dir + "/" + rev); err == nil && endsWithHash(target) {
+			return target[len(target)-40:], nil
+		}
+	}
+	return "", notFound("no branch, tag or commit called %s", rev)
+}
+
+func (h *FuseAPI) commit(ctx context.Context, rev string) (*apiCommit, error) {
+	id, err := h.resolve(ctx, rev)
+	if err != nil {
+		return nil, err
+	}
+	text, err := readCommit(ctx, h.nfs, id)
+	if err != nil {
+		return nil, err
+	}
+	commit := &apiCommit{Hash: id, Parents: []string{}}
+	header, message, _ := strings.Cut(text, "\n\n")
+	commit.Message = message
+	for _, line := range strings.Split(header, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author = parseSignature(value)
+		case "committer":
+			commit.Committer = parseSignature(value)
+		}
+	}
+	return commit, nil
+}
+
+/* "Julia Evans <julia@example.com> 1700334722 -0500" */
+func parseSignature(s string) apiSignature {
+	var sig apiSignature
+	lt, gt := strings.LastIndex(s, "<"), strings.LastIndex(s, ">")
+	if lt < 0 || gt < lt {
+		sig.Name = s
+		return sig
+	}
+	sig.Name = strings.TrimSpace(s[:lt])
+	sig.Email = s[lt+1 : gt]
+	fields := strings.Fields(s[gt+1:])
+	if len(fields) != 2 {
+		return sig
+	}
+	seconds, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return sig
+	}
+	tz, err := time.Parse("-0700", fields[1])
+	if err != nil {
+		tz = time.Unix(0, 0).UTC()
+	}
+	sig.Date = time.Unix(seconds, 0).In(tz.Location())
+	return sig
+}
+
+/* the node at `p` inside `rev` */
+func (h *FuseAPI) find(ctx context.Context, rev, p string) (string, fs.Node, error) {
+	id, err := h.resolve(ctx, rev)
+	if err != nil {
+		return "", nil, err
+	}
+	node, err := h.nfs.findNode(ctx, commitPath(id)+"/"+p)
+	if err != nil {
+		if os.IsNotExist(toOSError(err)) {
+			return "", nil, notFound("%s doesn't exist in %s", p, rev)
+		}
+		return "", nil, err
+	}
+	return id, node, nil
+}
+
+func objectID(node fs.Node) string {
+	if n, ok := node.(GitObject); ok {
+		return n.ObjectID().String()
+	}
+	return ""
+}
+
+func (h *FuseAPI) tree(ctx context.Context, rev, p string) (*apiTree, error) {
+	id, node, err := h.find(ctx, rev, p)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := getFileInfos(node)
+	if err != nil {
+		return nil, err
+	}
+	info, err := nodeToFileInfo(node, getFilename(p))
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, notFound("%s is not a directory in %s", p, rev)
+	}
+	tree := &apiTree{Path: p, Hash: objectID(node), Entries: []apiTreeEntry{}}
+	dir := strings.TrimSuffix(commitPath(id)+"/"+p, "/")
+	for _, info := range infos {
+		entry := apiTreeEntry{Name: info.Name(), Type: "blob", Size: info.Size()}
+		child, err := h.nfs.findLink(ctx, dir+"/"+info.Name())
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case info.IsDir():
+			entry.Type, entry.Size = "tree", 0
+		case info.Mode()&os.ModeSymlink != 0:
+			entry.Type, entry.Size = "symlink", 0
+			entry.Target, _ = child.(fs.NodeReadlinker).Readlink(ctx, nil)
+		}
+		entry.Hash = objectID(child)
+		tree.Entries = append(tree.Entries, entry)
+	}
+	return tree, nil
+}
+
+func (h *FuseAPI) blob(ctx context.Context, rev, p string) (*apiBlob, error) {
+	_, node, err := h.find(ctx, rev, p)
+	if err != nil {
+		return nil, err
+	}
+	info, err := nodeToFileInfo(node, getFilename(p))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, notFound("%s is a directory in %s", p, rev)
+	}
+	file := &FuseFile{node: node, name: info.Name()}
+	defer file.Close()
+	if err := file.ReadBytes(); err != nil {
+		return nil, err
+	}
+	blob := &apiBlob{Path: p, Hash: objectID(node), Size: info.Size(), Encoding: "utf-8"}
+	if utf8.Valid(file.allBytes) {
+		blob.Content = string(file.allBytes)
+	} else {
+		blob.Encoding = "base64"
+		blob.Content = base64.StdEncoding.EncodeToString(file.allBytes)
+	}
+	return blob, nil
+}
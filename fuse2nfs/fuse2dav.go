@@ -2,13 +2,14 @@ package fuse2nfs
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 
 	"github.com/anacrolix/fuse/fs"
+	"github.com/go-git/go-git/v5/plumbing"
 	"golang.org/x/net/webdav"
 )
 
@@ -16,55 +17,73 @@ import (
 
 type FuseDavFS struct {
 	fs fs.FS
+	/* so that we share its node cache */
+	nfs *FuseNFSfs
 }
 
 type FuseDavFile struct {
-	node      fs.Node
-	name      string
-	bytesRead int
-	allBytes  []byte
+	/* does the reading & seeking, so we have to keep the same one around */
+	file      *FuseFile
+	path      string
+	nfs       *FuseNFSfs
 	filesRead int
 	allFiles  []os.FileInfo
 }
 
-func (f *FuseDavFile) ToNFSFile() *FuseFile {
-	return &FuseFile{node: f.node, name: f.name, bytesRead: f.bytesRead, allBytes: f.allBytes, filesRead: f.filesRead, allFiles: f.allFiles}
+/* nodes that are a git object, like the files in commits/ */
+type GitObject interface {
+	ObjectID() plumbing.Hash
 }
 
-func Fuse2Dav(fs fs.FS) webdav.FileSystem {
-	return webdav.FileSystem(&FuseDavFS{fs: fs})
+/* os.FileInfo with an ETag, see davFileInfo.ETag */
+type davFileInfo struct {
+	os.FileInfo
+	path string
+	nfs  *FuseNFSfs
 }
 
+func Fuse2Dav(fs fs.FS, opts Options) webdav.FileSystem {
+	return webdav.FileSystem(&FuseDavFS{fs: fs, nfs: newFuseNFSfs(fs, opts)})
+}
+
+/* the only things you can change are refs, with Rename and RemoveAll */
+
 func (fs *FuseDavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
-	return fmt.Errorf("Not implemented")
+	return os.ErrPermission
 }
 func (fs *FuseDavFS) RemoveAll(ctx context.Context, name string) error {
-	return fmt.Errorf("Not implemented")
+	return fs.nfs.Remove(name)
 }
 func (fs *FuseDavFS) Rename(ctx context.Context, oldName, newName string) error {
-	return fmt.Errorf("Not implemented")
+	return fs.nfs.Rename(oldName, newName)
 }
 
 func (f *FuseDavFile) Write(p []byte) (n int, err error) {
-	return 0, fmt.Errorf("Not implemented")
+	return 0, os.ErrPermission
 }
 
 func (fs *FuseDavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
-	nfs := Fuse2NFS(fs.fs)
-	return nfs.Stat(name)
+	info, err := fs.nfs.Stat(name)
+	if err != nil {
+		return nil, toOSError(err)
+	}
+	return davFileInfo{info, name, fs.nfs}, nil
 }
 
 func (f *FuseDavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
-	node, err := findNode(ctx, f.fs, name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+	node, err := f.nfs.findNode(ctx, name)
 	if err != nil {
-		return nil, err
+		/* so that webdav knows it's a 404 */
+		return nil, toOSError(err)
 	}
-	parts := strings.Split(name, "/")
-	return &FuseDavFile{node: node, name: parts[len(parts)-1]}, nil
+	return &FuseDavFile{file: &FuseFile{node: node, name: getFilename(name)}, path: name, nfs: f.nfs}, nil
 }
 
 func (f *FuseDavFile) Close() error {
-	return nil
+	return f.file.Close()
 }
 
 func DebugLogger(r *http.Request, err error) {
@@ -76,35 +95,61 @@ func DebugLogger(r *http.Request, err error) {
 }
 
 func (f *FuseDavFile) Read(p []byte) (int, error) {
-	fusefile := &FuseFile{node: f.node, name: f.name}
-	return fusefile.Read(p)
+	return f.file.Read(p)
 }
 
+/* same as os.File.Readdir */
 func (f *FuseDavFile) Readdir(count int) ([]os.FileInfo, error) {
-	node := f.node
 	if f.allFiles == nil {
-		var err error
-		f.allFiles, err = getFileInfos(node)
+		/* not getFileInfos, so that symlinks get followed */
+		infos, err := f.nfs.ReadDir(f.path)
 		if err != nil {
-			return nil, err
+			return nil, toOSError(err)
 		}
+		f.allFiles = make([]os.FileInfo, len(infos))
+		for i, info := range infos {
+			f.allFiles[i] = davFileInfo{info, strings.TrimSuffix(f.path, "/") + "/" + info.Name(), f.nfs}
+		}
+	}
+	remaining := f.allFiles[f.filesRead:]
+	if count <= 0 {
+		f.filesRead = len(f.allFiles)
+		return remaining, nil
 	}
-	if count == 0 {
-		count = len(f.allFiles)
+	if len(remaining) == 0 {
+		return nil, io.EOF
 	}
-	infos := f.allFiles[f.filesRead : f.filesRead+count]
-	f.filesRead += len(infos)
-	return infos, nil
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.filesRead += count
+	return remaining[:count], nil
 }
 
 func (f *FuseDavFile) Seek(offset int64, whence int) (int64, error) {
-	nfs := f.ToNFSFile()
-	nfs.Seek(offset, whence)
-	f.bytesRead = nfs.bytesRead
-	f.allBytes = nfs.allBytes
-	return int64(f.bytesRead), nil
+	return f.file.Seek(offset, whence)
 }
 
 func (f *FuseDavFile) Stat() (os.FileInfo, error) {
-	return nodeToFileInfo(f.node, f.name)
+	info, err := statNode(f.file.node, f.file.name)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{info, f.path, f.nfs}, nil
+}
+
+/*
+files in git never change unless their hash does, so the hash is a much
+better ETag than webdav's default one (the mtime and size). Everything else
+gets the default.
+*/
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	node, err := fi.nfs.findNode(ctx, fi.path)
+	if err != nil {
+		return "", err
+	}
+	if n, ok := node.(GitObject); ok {
+		return `"` + n.ObjectID().String() + `"`, nil
+	}
+	return "", webdav.ErrNotImplemented
 }
@@ -0,0 +1,145 @@
+package fuse2nfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+)
+
+/*
+  Copies things out of the filesystem without mounting it, for
+  `git-commit-folders export`:
+
+  $ git-commit-folders export archives/main.tar.gz release.tgz
+  $ git-commit-folders export oci/v1.2.3 ./image
+
+  Symlinks in the path you ask for get followed, but symlinks inside a folder
+  you're copying stay symlinks, like `cp -r`.
+*/
+
+type Exporter struct {
+	nfs *FuseNFSfs
+}
+
+func Fuse2Dir(fs fs.FS) *Exporter {
+	return &Exporter{nfs: newFuseNFSfs(fs, Options{FollowSymlinks: true})}
+}
+
+/* copies the file at `src` to w */
+func (e *Exporter) WriteFile(src string, w io.Writer) error {
+	ctx := context.Background()
+	node, err := e.nfs.findNode(ctx, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, toOSError(err))
+	}
+	info, err := nodeToFileInfo(node, getFilename(src))
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a folder", src)
+	}
+	return writeNode(ctx, node, w)
+}
+
+/* copies the file or folder at `src` to `dest` on disk */
+func (e *Exporter) Copy(src, dest string) error {
+	ctx := context.Background()
+	node, err := e.nfs.findNode(ctx, src)
+	if err != nil {
+		return fmt.Errorf("%s: %w", src, toOSError(err))
+	}
+	info, err := nodeToFileInfo(node, getFilename(src))
+	if err != nil {
+		return err
+	}
+	return e.copy(ctx, src, node, info, dest)
+}
+
+func (e *Exporter) copy(ctx context.Context, src string, node fs.Node, info os.FileInfo, dest string) error {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := e.nfs.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dest)
+	case info.IsDir():
+		if err := os.MkdirAll(dest, 0o755); err != nil {
+			return err
+		}
+		infos, err := getFileInfos(node)
+		if err != nil {
+			return err
+		}
+		for _, child := range infos {
+			p := path.Join(src, child.Name())
+			childNode, err := e.nfs.findLink(ctx, p)
+			if err != nil {
+				return err
+			}
+			if err := e.copy(ctx, p, childNode, child, filepath.Join(dest, child.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	perm := os.FileMode(0o644)
+	if info.Mode()&0o111 != 0 {
+		perm = 0o755
+	}
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if err := writeNode(ctx, node, file); err != nil {
+		file.Close()
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return file.Close()
+}
+
+/*
+files that have their own Open (like archives/) are made while you read them,
+so read them the way FUSE would instead of getting the whole thing at once
+*/
+func writeNode(ctx context.Context, node fs.Node, w io.Writer) error {
+	stream, err := openStream(ctx, node)
+	if err != nil {
+		return err
+	}
+	if stream != nil {
+		defer stream.release()
+		return copyHandle(ctx, stream.reader, w)
+	}
+	file := &FuseFile{node: node}
+	if err := file.ReadBytes(); err != nil {
+		return err
+	}
+	_, err = w.Write(file.allBytes)
+	return err
+}
+
+func copyHandle(ctx context.Context, r fs.HandleReader, w io.Writer) error {
+	var offset int64
+	for {
+		req := &fuse.ReadRequest{Offset: offset, Size: 1 << 20}
+		resp := &fuse.ReadResponse{}
+		if err := r.Read(ctx, req, resp); err != nil {
+			return err
+		}
+		if len(resp.Data) == 0 {
+			return nil
+		}
+		if _, err := w.Write(resp.Data); err != nil {
+			return err
+		}
+		offset += int64(len(resp.Data))
+	}
+}
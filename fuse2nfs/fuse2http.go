@@ -0,0 +1,302 @@
+package fuse2nfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/fuse/fs"
+)
+
+/*
+  A web page for every folder and file, for people who'd rather click around
+  in a browser than mount something.
+
+  * folders are a list of links
+  * files are shown with line numbers (and some syntax highlighting), add
+    ?raw to download them
+  * symlinks (like branches/main) redirect to wherever they point
+  * commit folders show the commit message, with links to the parents
+*/
+
+type FuseHTTP struct {
+	nfs *FuseNFSfs
+}
+
+func Fuse2HTTP(fs fs.FS) http.Handler {
+	return &FuseHTTP{nfs: newFuseNFSfs(fs, Options{FollowSymlinks: true})}
+}
+
+/* don't try to show huge files in the browser */
+const maxHTMLFileSize = 1 << 20
+
+type dirEntry struct {
+	Name   string
+	Href   string
+	IsDir  bool
+	Size   int64
+	Target string /* for symlinks */
+}
+
+type crumb struct {
+	Name string
+	Href string
+}
+
+type page struct {
+	Title  string
+	Crumbs []crumb
+	/* folders */
+	Commit  string
+	Parents []string
+	Entries []dirEntry
+	/* files */
+	Lines   string
+	Code    template.HTML
+	TooBig  bool
+	Binary  bool
+	RawHref string
+}
+
+func (h *FuseHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "this is read only", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	p := r.URL.Path
+	/* symlinks redirect, so that the URL says where you are */
+	link, err := h.nfs.findLink(ctx, p)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if n, ok := link.(fs.NodeReadlinker); ok {
+		target, err := n.Readlink(ctx, nil)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		/* not a permanent redirect, branches move */
+		http.Redirect(w, r, path.Join(path.Dir(strings.TrimSuffix(p, "/")), target), http.StatusFound)
+		return
+	}
+	info, err := nodeToFileInfo(link, getFilename(p))
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(p, "/") {
+			http.Redirect(w, r, p+"/", http.StatusMovedPermanently)
+			return
+		}
+		h.serveDir(ctx, w, p, link)
+		return
+	}
+	if _, ok := r.URL.Query()["raw"]; ok {
+		serveRaw(w, r, link, info)
+		return
+	}
+	h.serveFile(w, p, link, info)
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	if os.IsNotExist(toOSError(err)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("HTTP: %s", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (h *FuseHTTP) serveDir(ctx context.Context, w http.ResponseWriter, p string, node fs.Node) {
+	infos, err := getFileInfos(node)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	pg := newPage(p)
+	for _, info := range infos {
+		entry := dirEntry{Name: info.Name(), Href: url.PathEscape(info.Name()), IsDir: info.IsDir(), Size: info.Size()}
+		if info.IsDir() {
+			entry.Href += "/"
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			entry.Target, _ = h.nfs.Readlink(p + info.Name())
+		}
+		pg.Entries = append(pg.Entries, entry)
+	}
+	pg.Commit, pg.Parents = h.commitInfo(ctx, p)
+	renderPage(w, pg)
+}
+
+/*
+if `p` is a commit's folder (like commits/ab/abcd/<hash>/), returns `git
+cat-file -p` for the commit (from objects/) and its parents
+*/
+func (h *FuseHTTP) commitInfo(ctx context.Context, p string) (string, []string) {
+	name := getFilename(p)
+	if !endsWithHash(name) {
+		return "", nil
+	}
+	text, err := readCommit(ctx, h.nfs, name[len(name)-40:])
+	if err != nil {
+		return "", nil
+	}
+	var parents []string
+	for _, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "parent ") {
+			parents = append(parents, "/"+commitPath(strings.TrimPrefix(line, "parent "))+"/")
+		}
+	}
+	return text, parents
+}
+
+/* `git cat-file -p` for a commit, from objects/ */
+func readCommit(ctx context.Context, f *FuseNFSfs, id string) (string, error) {
+	node, err := f.findNode(ctx, "objects/"+id[:2]+"/"+id[:4]+"/"+id+".txt")
+	if err != nil {
+		return "", err
+	}
+	file := &FuseFile{node: node}
+	if err := file.ReadBytes(); err != nil {
+		return "", err
+	}
+	if !bytes.HasPrefix(file.allBytes, []byte("tree ")) {
+		return "", fmt.Errorf("%s isn't a commit", id)
+	}
+	return string(file.allBytes), nil
+}
+
+func commitPath(id string) string {
+	return "commits/" + id[:2] + "/" + id[:4] + "/" + id
+}
+
+func serveRaw(w http.ResponseWriter, r *http.Request, node fs.Node, info os.FileInfo) {
+	if n, ok := node.(GitObject); ok {
+		/* ServeContent takes care of If-None-Match */
+		w.Header().Set("Etag", `"`+n.ObjectID().String()+`"`)
+	}
+	file := &FuseFile{node: node, name: info.Name()}
+	defer file.Close()
+	/* archives/ get read as they're made, everything else all at once */
+	err := file.open()
+	if err == nil && file.stream == nil {
+		err = file.ReadBytes()
+	}
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func (h *FuseHTTP) serveFile(w http.ResponseWriter, p string, node fs.Node, info os.FileInfo) {
+	pg := newPage(p)
+	pg.RawHref = url.PathEscape(info.Name()) + "?raw"
+	if info.Size() > maxHTMLFileSize {
+		pg.TooBig = true
+		renderPage(w, pg)
+		return
+	}
+	file := &FuseFile{node: node, name: info.Name()}
+	defer file.Close()
+	if err := file.ReadBytes(); err != nil {
+		httpError(w, err)
+		return
+	}
+	content := file.allBytes
+	start := content
+	if len(start) > 8000 {
+		start = start[:8000]
+	}
+	if bytes.IndexByte(start, 0) >= 0 {
+		pg.Binary = true
+		renderPage(w, pg)
+		return
+	}
+	src := strings.TrimSuffix(string(content), "\n")
+	var lines strings.Builder
+	for i := 1; i <= strings.Count(src, "\n")+1; i++ {
+		lines.WriteString(strconv.Itoa(i) + "\n")
+	}
+	pg.Lines = lines.String()
+	pg.Code = highlight(info.Name(), src)
+	renderPage(w, pg)
+}
+
+func newPage(p string) *page {
+	pg := &page{Title: p, Crumbs: []crumb{{Name: "/", Href: "/"}}}
+	href := "/"
+	for _, part := range splitParts(p) {
+		href += url.PathEscape(part) + "/"
+		pg.Crumbs = append(pg.Crumbs, crumb{Name: part, Href: href})
+	}
+	/* the last one is where we are, it doesn't need a link */
+	pg.Crumbs[len(pg.Crumbs)-1].Href = ""
+	return pg
+}
+
+func renderPage(w http.ResponseWriter, pg *page) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, pg); err != nil {
+		log.Printf("HTTP: %s", err)
+	}
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+a { color: #0645ad; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.crumbs { font-size: 1.2em; margin-bottom: 1em; }
+.commit { background: #f6f8fa; padding: 1em; }
+td { padding: 0.1em 1em 0.1em 0; }
+.size, .target { color: #666; }
+.file { display: flex; font-size: 0.9em; }
+.file pre { margin: 0; }
+.lines { color: #999; text-align: right; padding-right: 1em; user-select: none; }
+.c { color: #6a737d; }
+.s { color: #032f62; }
+.n { color: #005cc5; }
+.k { color: #d73a49; }
+</style>
+</head>
+<body>
+<div class="crumbs">
+{{range $i, $c := .Crumbs}}{{if $i}} / {{end}}{{if $c.Href}}<a href="{{$c.Href}}">{{$c.Name}}</a>{{else}}<b>{{$c.Name}}</b>{{end}}{{end}}
+</div>
+{{if .Commit}}
+<pre class="commit">{{.Commit}}</pre>
+{{range .Parents}}<p>parent: <a href="{{.}}">{{.}}</a></p>{{end}}
+{{end}}
+{{if .Entries}}
+<table>
+{{range .Entries}}<tr>
+<td><a href="{{.Href}}">{{.Name}}{{if .IsDir}}/{{end}}</a>{{if .Target}} <span class="target">&rarr; {{.Target}}</span>{{end}}</td>
+<td class="size">{{if not .IsDir}}{{if not .Target}}{{.Size}}{{end}}{{end}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+{{if .RawHref}}
+<p><a href="{{.RawHref}}">raw</a></p>
+{{if .TooBig}}<p>This file is too big to show here.</p>{{end}}
+{{if .Binary}}<p>This looks like a binary file.</p>{{end}}
+{{if .Code}}<div class="file"><pre class="lines">{{.Lines}}</pre><pre>{{.Code}}</pre></div>{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -1,7 +1,9 @@
 package fuse2nfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -19,7 +21,18 @@ import (
 )
 
 type FuseNFSfs struct {
-	fs fs.FS
+	fs      fs.FS
+	nodes   *nodeCache
+	streams *streamCache
+	opts    Options
+}
+
+type Options struct {
+	/*
+	  resolve symlinks ourselves, so that the client sees what they point to
+	  instead of a symlink (for WebDAV, which doesn't know about symlinks)
+	*/
+	FollowSymlinks bool
 }
 type FuseAttr struct {
 	attr fuse.Attr
@@ -32,10 +45,31 @@ type FuseFile struct {
 	allBytes  []byte
 	filesRead int
 	allFiles  []os.FileInfo
+	/* for nodes with their own Open, see streams.go */
+	opened bool
+	stream *nodeStream
+	/* if the stream came from FuseNFSfs's cache, which path to give it back for */
+	cache *streamCache
+	path  string
+}
+
+func Fuse2NFS(fs fs.FS, opts Options) billy.Filesystem {
+	return newFuseNFSfs(fs, opts)
+}
+
+func newFuseNFSfs(fs fs.FS, opts Options) *FuseNFSfs {
+	return &FuseNFSfs{fs: fs, nodes: newNodeCache(), streams: newStreamCache(), opts: opts}
+}
+
+/* finds `path`, following symlinks if we're supposed to */
+func (f *FuseNFSfs) findNode(ctx context.Context, path string) (fs.Node, error) {
+	follow := f.opts.FollowSymlinks
+	return f.nodes.findNode(ctx, f.fs, path, follow, follow)
 }
 
-func Fuse2NFS(fs fs.FS) billy.Filesystem {
-	return &FuseNFSfs{fs: fs}
+/* like findNode, but if `path` itself is a symlink we return the symlink */
+func (f *FuseNFSfs) findLink(ctx context.Context, path string) (fs.Node, error) {
+	return f.nodes.findNode(ctx, f.fs, path, f.opts.FollowSymlinks, false)
 }
 
 func RunServer(fs billy.Filesystem, port int) {
@@ -43,8 +77,7 @@ func RunServer(fs billy.Filesystem, port int) {
 	panicOnErr(err, "starting TCP listener")
 	fmt.Printf("Server running at %s\n", listener.Addr())
 	handler := nfshelper.NewNullAuthHandler(fs)
-	cacheHelper := nfshelper.NewCachingHandler(handler, 10000)
-	panicOnErr(nfs.Serve(listener, cacheHelper), "serving nfs")
+	panicOnErr(nfs.Serve(listener, NewStableHandles(handler, fs)), "serving nfs")
 }
 
 func panicOnErr(err error, desc ...interface{}) {
@@ -88,10 +121,6 @@ func (f *FuseFile) Truncate(size int64) error {
 	return fmt.Errorf("not implemented")
 }
 
-func (f *FuseNFSfs) Symlink(target, link string) error {
-	return fmt.Errorf("not implemented")
-}
-
 func (f *FuseNFSfs) TempFile(dir, prefix string) (billy.File, error) {
 	return nil, fmt.Errorf("not implemented")
 }
@@ -100,14 +129,6 @@ func (fs *FuseNFSfs) Join(elem ...string) string {
 	return strings.Join(elem, "/")
 }
 
-func (fs *FuseNFSfs) Remove(path string) error {
-	return fmt.Errorf("not implemented")
-}
-
-func (fs *FuseNFSfs) Rename(from, to string) error {
-	return fmt.Errorf("not implemented")
-}
-
 /* FileInfo implementation for FuseAttr */
 
 func (f FuseAttr) Name() string {
@@ -122,9 +143,12 @@ func (f FuseAttr) Mode() os.FileMode {
 	return f.attr.Mode
 }
 
+/* NFS clients look at this to decide if their cache is stale (see fuse/watch.go) */
 func (f FuseAttr) ModTime() time.Time {
-	// TODO: wrong
-	return time.Unix(0, 0)
+	if f.attr.Mtime.IsZero() {
+		return time.Unix(0, 0)
+	}
+	return f.attr.Mtime
 }
 
 func (f FuseAttr) IsDir() bool {
@@ -132,37 +156,36 @@ func (f FuseAttr) IsDir() bool {
 }
 
 func (f FuseAttr) Sys() interface{} {
-	return &syscall.Stat_t{
+	stat := &syscall.Stat_t{
 		Uid:   uint32(os.Getuid()),
 		Gid:   uint32(os.Getgid()),
 		Rdev:  0,
 		Ino:   f.attr.Inode,
 		Nlink: 1,
 	}
+	/* blobs with -hardlink-blobs */
+	if f.attr.Nlink > 1 {
+		setNlink(&stat.Nlink, f.attr.Nlink)
+	}
+	return stat
 }
 
-func findNode(ctx context.Context, root fs.FS, path string) (fs.Node, error) {
-	lookedUp := []string{}
-	node, err := root.Root()
-	if err != nil {
-		return nil, err
+/* Nlink is a uint64 on Linux and a uint16 on Mac */
+func setNlink[T uint16 | uint32 | uint64](nlink *T, n uint32) {
+	*nlink = T(n)
+}
+
+/* looks up `name` in `node`, which is at `lookedUp` (see nodecache.go for the whole path) */
+func lookup(ctx context.Context, node fs.Node, lookedUp []string, name string) (fs.Node, error) {
+	n, ok := node.(fs.NodeStringLookuper)
+	if !ok {
+		return nil, fmt.Errorf("Path %s does not implement NodeStringLookuper", strings.Join(lookedUp, "/"))
 	}
-	nameParts := strings.Split(path, "/")
-	for _, part := range nameParts {
-		if part == "" {
-			continue
-		}
-		if n, ok := node.(fs.NodeStringLookuper); ok {
-			node, err = n.Lookup(ctx, part)
-			if err != nil {
-				return nil, fmt.Errorf("Error looking up %s: %s", strings.Join(lookedUp, "/"), err)
-			}
-			lookedUp = append(lookedUp, part)
-		} else {
-			return nil, fmt.Errorf("Path %s does not implement NodeStringLookuper", strings.Join(lookedUp, "/"))
-		}
+	child, err := n.Lookup(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("Error looking up %s: %w", strings.Join(lookedUp, "/"), err)
 	}
-	return node, nil
+	return child, nil
 }
 
 func nodeToFileInfo(node fs.Node, filename string) (os.FileInfo, error) {
@@ -175,17 +198,38 @@ func nodeToFileInfo(node fs.Node, filename string) (os.FileInfo, error) {
 	return FuseAttr{attr: a, name: filename}, nil
 }
 
+/* like nodeToFileInfo, but with the real size even if it's slow to get (see NodeSizer) */
+func statNode(node fs.Node, filename string) (os.FileInfo, error) {
+	info, err := nodeToFileInfo(node, filename)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := node.(NodeSizer); ok {
+		attr := info.(FuseAttr)
+		if attr.attr.Size, err = n.Size(context.Background()); err != nil {
+			return nil, err
+		}
+		return attr, nil
+	}
+	return info, nil
+}
+
 func (f *FuseNFSfs) Stat(path string) (os.FileInfo, error) {
 	ctx := context.Background()
-	node, err := findNode(ctx, f.fs, path)
+	node, err := f.findNode(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	return nodeToFileInfo(node, getFilename(path))
+	return statNode(node, getFilename(path))
 }
 
 func (f *FuseNFSfs) Lstat(filename string) (os.FileInfo, error) {
-	return f.Stat(filename)
+	ctx := context.Background()
+	node, err := f.findLink(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	return statNode(node, getFilename(filename))
 }
 
 func getFilename(path string) string {
@@ -201,11 +245,15 @@ func getFilename(path string) string {
 
 func (f *FuseNFSfs) Open(path string) (billy.File, error) {
 	ctx := context.Background()
-	node, err := findNode(ctx, f.fs, path)
+	node, err := f.findNode(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	return &FuseFile{node: node, name: getFilename(path)}, nil
+	file := &FuseFile{node: node, name: getFilename(path), opened: true, cache: f.streams, path: path}
+	if file.stream, err = f.streams.get(ctx, path, node); err != nil {
+		return nil, err
+	}
+	return file, nil
 }
 
 func (f *FuseNFSfs) OpenFile(filename string, flag int, perm os.FileMode) (billy.File, error) {
@@ -214,15 +262,70 @@ func (f *FuseNFSfs) OpenFile(filename string, flag int, perm os.FileMode) (billy
 
 func (f *FuseNFSfs) ReadDir(path string) ([]os.FileInfo, error) {
 	ctx := context.Background()
-	node, err := findNode(ctx, f.fs, path)
+	node, err := f.findNode(ctx, path)
 	if err != nil {
 		return nil, err
 	}
-	return getFileInfos(node)
+	infos, err := getFileInfos(node)
+	if err != nil || !f.opts.FollowSymlinks {
+		return infos, err
+	}
+	for i, info := range infos {
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		/* if it's broken, just show the symlink */
+		if target, err := f.Stat(f.Join(path, info.Name())); err == nil {
+			infos[i] = target
+		}
+	}
+	return infos, nil
+}
+
+/* just the names, without looking anything up */
+func (f *FuseNFSfs) readDirNames(path string) ([]string, error) {
+	ctx := context.Background()
+	node, err := f.findNode(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	n, ok := node.(fs.HandleReadDirAller)
+	if !ok {
+		return []string{}, nil
+	}
+	files, err := n.ReadDirAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name
+	}
+	return names, nil
+}
+
+/*
+directories can implement this if they can get the attributes of all their
+entries at once (like git trees). Otherwise we have to Lookup and Attr every
+entry one at a time.
+*/
+type HandleReadDirAttrser interface {
+	ReadDirAttrs(ctx context.Context) ([]fuse.Dirent, []fuse.Attr, error)
 }
 
 func getFileInfos(node fs.Node) ([]os.FileInfo, error) {
 	ctx := context.Background()
+	if n, ok := node.(HandleReadDirAttrser); ok {
+		files, attrs, err := n.ReadDirAttrs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		dirents := make([]os.FileInfo, len(files))
+		for i, file := range files {
+			dirents[i] = FuseAttr{attr: attrs[i], name: file.Name}
+		}
+		return dirents, nil
+	}
 	if _, ok := node.(fs.HandleReadDirAller); !ok {
 		return []os.FileInfo{}, nil
 	}
@@ -248,7 +351,7 @@ func getFileInfos(node fs.Node) ([]os.FileInfo, error) {
 
 func (f *FuseNFSfs) Readlink(filename string) (string, error) {
 	ctx := context.Background()
-	node, err := findNode(ctx, f.fs, filename)
+	node, err := f.findLink(ctx, filename)
 	if err != nil {
 		return "", err
 	}
@@ -258,7 +361,94 @@ func (f *FuseNFSfs) Readlink(filename string) (string, error) {
 	return "", fmt.Errorf("Node does not implement NodeReadlinker")
 }
 
+/*
+Symlink, Remove and Rename only work in directories that implement them on
+the FUSE side (like branches/ with -writable-refs)
+*/
+
+func (f *FuseNFSfs) Symlink(target, link string) error {
+	ctx := context.Background()
+	dirPath, name := splitPath(link)
+	dir, err := f.findNode(ctx, dirPath)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.(fs.NodeSymlinker)
+	if !ok {
+		return os.ErrPermission
+	}
+	_, err = n.Symlink(ctx, &fuse.SymlinkRequest{NewName: name, Target: target})
+	f.nodes.forget(link)
+	return toOSError(err)
+}
+
+func (f *FuseNFSfs) Remove(path string) error {
+	ctx := context.Background()
+	dirPath, name := splitPath(path)
+	dir, err := f.findNode(ctx, dirPath)
+	if err != nil {
+		return err
+	}
+	n, ok := dir.(fs.NodeRemover)
+	if !ok {
+		return os.ErrPermission
+	}
+	err = n.Remove(ctx, &fuse.RemoveRequest{Name: name})
+	f.nodes.forget(path)
+	return toOSError(err)
+}
+
+func (f *FuseNFSfs) Rename(from, to string) error {
+	ctx := context.Background()
+	fromDirPath, fromName := splitPath(from)
+	toDirPath, toName := splitPath(to)
+	fromDir, err := f.findNode(ctx, fromDirPath)
+	if err != nil {
+		return err
+	}
+	toDir, err := f.findNode(ctx, toDirPath)
+	if err != nil {
+		return err
+	}
+	n, ok := fromDir.(fs.NodeRenamer)
+	if !ok {
+		return os.ErrPermission
+	}
+	err = n.Rename(ctx, &fuse.RenameRequest{OldName: fromName, NewName: toName}, toDir)
+	f.nodes.forget(from)
+	f.nodes.forget(to)
+	return toOSError(err)
+}
+
+/* "branches/main" -> "branches", "main" */
+func splitPath(path string) (string, string) {
+	path = strings.TrimSuffix(path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+/* the NFS server knows what to do with syscall.Errno but not with fuse.Errno */
+func toOSError(err error) error {
+	var errno fuse.ErrorNumber
+	if errors.As(err, &errno) {
+		return syscall.Errno(errno.Errno())
+	}
+	return err
+}
+
 func (f *FuseFile) Close() error {
+	if f.stream == nil {
+		return nil
+	}
+	if f.cache != nil {
+		f.cache.put(f.path, f.stream)
+	} else {
+		f.stream.release()
+	}
+	f.stream = nil
 	return nil
 }
 
@@ -266,12 +456,34 @@ func (f *FuseFile) Name() string {
 	return f.name
 }
 
+/* opens the node if it has its own Open (see streams.go), the first time we read */
+func (f *FuseFile) open() error {
+	if f.opened {
+		return nil
+	}
+	f.opened = true
+	var err error
+	f.stream, err = openStream(context.Background(), f.node)
+	return err
+}
+
 func (f *FuseFile) ReadBytes() error {
 	if f.allBytes != nil {
 		return nil
 	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if f.stream != nil {
+		var buf bytes.Buffer
+		if err := copyHandle(ctx, f.stream.reader, &buf); err != nil {
+			return err
+		}
+		f.allBytes = buf.Bytes()
+		return nil
+	}
 	if n, ok := f.node.(fs.HandleReadAller); ok {
-		ctx := context.Background()
 		var err error
 		f.allBytes, err = n.ReadAll(ctx)
 		if err != nil {
@@ -284,37 +496,78 @@ func (f *FuseFile) ReadBytes() error {
 }
 
 func (f *FuseFile) Read(p []byte) (n int, err error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	if f.stream != nil && f.allBytes == nil {
+		n, err = f.stream.readAt(p, int64(f.bytesRead))
+		f.bytesRead += n
+		if n > 0 && err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
 	err = f.ReadBytes()
 	if err != nil {
 		return 0, err
 	}
 
+	if f.bytesRead >= len(f.allBytes) && len(p) > 0 {
+		return 0, io.EOF
+	}
 	n = copy(p, f.allBytes[f.bytesRead:])
 	f.bytesRead += n
 	return n, nil
 }
 
 func (f *FuseFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	if f.stream != nil && f.allBytes == nil {
+		return f.stream.readAt(p, off)
+	}
 	err = f.ReadBytes()
 	if err != nil {
 		return 0, err
 	}
+	if off >= int64(len(f.allBytes)) {
+		return 0, io.EOF
+	}
 	n = copy(p, f.allBytes[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
 	return n, nil
 }
 
 func (f *FuseFile) Seek(offset int64, whence int) (int64, error) {
-	err := f.ReadBytes()
-	if err != nil {
+	if err := f.open(); err != nil {
 		return 0, err
 	}
+	var size int64
+	if f.stream != nil && f.allBytes == nil {
+		/* only SeekEnd needs the size, and it can be slow to get */
+		if whence == io.SeekEnd {
+			info, err := statNode(f.node, f.name)
+			if err != nil {
+				return 0, err
+			}
+			size = info.Size()
+		}
+	} else {
+		if err := f.ReadBytes(); err != nil {
+			return 0, err
+		}
+		size = int64(len(f.allBytes))
+	}
 	switch whence {
 	case io.SeekStart:
 		f.bytesRead = int(offset)
 	case io.SeekCurrent:
 		f.bytesRead += int(offset)
 	case io.SeekEnd:
-		f.bytesRead = len(f.allBytes) + int(offset)
+		f.bytesRead = int(size) + int(offset)
 	}
 	return int64(f.bytesRead), nil
 }
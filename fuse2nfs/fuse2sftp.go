@@ -0,0 +1,561 @@
+package fuse2nfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/anacrolix/fuse/fs"
+	billy "github.com/go-git/go-billy/v5"
+	"golang.org/x/crypto/ssh"
+)
+
+/*
+  An SFTP server (over SSH), so you can look at the folders with any SFTP
+  client or with sshfs. It's read only, and you can only log in with a key
+  from the authorized keys file.
+
+  Like 9P (fuse29p.go), this is version 3 of the protocol written by hand on
+  top of FuseNFSfs. The spec is
+  https://datatracker.ietf.org/doc/html/draft-ietf-secsh-filexfer-02
+*/
+
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpLstat    = 7
+	sftpFstat    = 8
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRealpath = 16
+	sftpStat     = 17
+	sftpReadlink = 19
+	/* the ones that change things, we say no to all of them */
+	sftpWrite    = 6
+	sftpSetstat  = 9
+	sftpFsetstat = 10
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpRmdir    = 15
+	sftpRename   = 18
+	sftpSymlink  = 20
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+)
+
+/* status codes */
+const (
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+	sftpFailure          = 4
+	sftpBadMessage       = 5
+	sftpOpUnsupported    = 8
+)
+
+/* the open flags that would change the file */
+const (
+	sftpFlagWrite  = 0x02
+	sftpFlagAppend = 0x04
+	sftpFlagCreat  = 0x08
+	sftpFlagTrunc  = 0x10
+	sftpFlagExcl   = 0x20
+)
+
+const sftpMaxPacket = 256 * 1024
+
+/* how many directory entries we send at once */
+const sftpReaddirBatch = 100
+
+type SFTPServer struct {
+	config *ssh.ServerConfig
+	nfs    *FuseNFSfs
+}
+
+func Fuse2SFTP(fs fs.FS, hostKey ssh.Signer, authorizedKeys []ssh.PublicKey) *SFTPServer {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, k := range authorizedKeys {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+	/* the symlinks in the middle of a path get followed, the client does the rest */
+	return &SFTPServer{config: config, nfs: newFuseNFSfs(fs, Options{FollowSymlinks: true})}
+}
+
+/* reads the host key from `filename`, or makes a new one if it doesn't exist yet */
+func LoadHostKey(filename string) (ssh.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		block, err := ssh.MarshalPrivateKey(key, "git-commit-folders")
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(block)
+		if err := os.WriteFile(filename, data, 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Made a new SSH host key in %s", filename)
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+func LoadAuthorizedKeys(filename string) ([]ssh.PublicKey, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(data)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		keys = append(keys, key)
+		data = rest
+	}
+	return keys, nil
+}
+
+func (s *SFTPServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SFTPServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+	sshConn, channels, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		log.Printf("SFTP: %s", err)
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Printf("SFTP: %s", err)
+			return
+		}
+		go s.serveSession(channel, requests)
+	}
+}
+
+/* the only thing you can do in a session is start the sftp subsystem, no shells */
+func (s *SFTPServer) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		/* the payload is the subsystem's name as an SSH string */
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if ok {
+			go ssh.DiscardRequests(requests)
+			c := &sftpConn{rw: channel, nfs: s.nfs, handles: make(map[string]*sftpOpenFile)}
+			if err := c.serve(); err != nil && err != io.EOF {
+				log.Printf("SFTP: %s", err)
+			}
+			c.closeAll()
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+			return
+		}
+	}
+}
+
+type sftpConn struct {
+	rw      io.ReadWriter
+	nfs     *FuseNFSfs
+	handles map[string]*sftpOpenFile
+	nextID  int
+}
+
+type sftpOpenFile struct {
+	file billy.File
+	/* for directories */
+	path    string
+	entries []os.FileInfo
+	read    int
+}
+
+func (c *sftpConn) serve() error {
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c.rw, size[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(size[:])
+		if n < 1 || n > sftpMaxPacket {
+			return fmt.Errorf("bad packet size %d", n)
+		}
+		packet := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, packet); err != nil {
+			return err
+		}
+		var reply []byte
+		if packet[0] == sftpInit {
+			/* version 3, no extensions */
+			reply = sftpu32([]byte{sftpVersion}, 3)
+		} else {
+			d := &sftpDecoder{b: packet[1:]}
+			id := d.u32()
+			reply = c.handle(packet[0], id, d)
+			if d.err {
+				reply = sftpStatusReply(id, sftpBadMessage, "bad message")
+			}
+		}
+		if _, err := c.rw.Write(append(sftpu32(nil, uint32(len(reply))), reply...)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *sftpConn) handle(typ uint8, id uint32, d *sftpDecoder) []byte {
+	ctx := context.Background()
+	switch typ {
+	case sftpRealpath:
+		p, err := c.realpath(d.str())
+		if err != nil {
+			return sftpError(id, err)
+		}
+		info, err := c.nfs.Stat(p)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		return sftpNames(id, []os.FileInfo{info}, []string{p})
+	case sftpStat, sftpLstat:
+		p := d.str()
+		var info os.FileInfo
+		var err error
+		if typ == sftpStat {
+			info, err = c.nfs.Stat(p)
+		} else {
+			info, err = c.nfs.Lstat(p)
+		}
+		if err != nil {
+			return sftpError(id, err)
+		}
+		return sftpAttrsOf([]byte{sftpAttrs}, id, info)
+	case sftpReadlink:
+		p := d.str()
+		target, err := c.nfs.Readlink(p)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		info, err := c.nfs.Lstat(p)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		return sftpNames(id, []os.FileInfo{info}, []string{target})
+	case sftpOpen:
+		p, pflags := d.str(), d.u32()
+		if d.err {
+			return nil
+		}
+		/* clients can send other flags along with SSH_FXF_READ, as long as they don't write */
+		if pflags&(sftpFlagWrite|sftpFlagAppend|sftpFlagCreat|sftpFlagTrunc|sftpFlagExcl) != 0 {
+			return sftpStatusReply(id, sftpPermissionDenied, "read only")
+		}
+		info, err := c.nfs.Stat(p)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		if info.IsDir() {
+			return sftpStatusReply(id, sftpFailure, "is a directory")
+		}
+		file, err := c.nfs.Open(p)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		return c.newHandle(id, &sftpOpenFile{file: file, path: p})
+	case sftpOpendir:
+		p := d.str()
+		if d.err {
+			return nil
+		}
+		node, err := c.nfs.findNode(ctx, p)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		if info, err := nodeToFileInfo(node, p); err != nil {
+			return sftpError(id, err)
+		} else if !info.IsDir() {
+			return sftpStatusReply(id, sftpFailure, "not a directory")
+		}
+		/* not ReadDir, because it would follow the symlinks */
+		entries, err := getFileInfos(node)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		return c.newHandle(id, &sftpOpenFile{path: p, entries: entries})
+	case sftpRead:
+		h, ok := c.handles[d.str()]
+		offset, length := d.u64(), d.u32()
+		if !ok || h.file == nil {
+			return sftpStatusReply(id, sftpFailure, "bad handle")
+		}
+		if length > sftpMaxPacket-64 {
+			length = sftpMaxPacket - 64
+		}
+		buf := make([]byte, length)
+		n, err := h.file.ReadAt(buf, int64(offset))
+		if n == 0 && err == io.EOF {
+			return sftpStatusReply(id, sftpEOF, "EOF")
+		} else if err != nil && err != io.EOF {
+			return sftpError(id, err)
+		}
+		return sftpstr(sftpu32([]byte{sftpData}, id), string(buf[:n]))
+	case sftpFstat:
+		h, ok := c.handles[d.str()]
+		if !ok {
+			return sftpStatusReply(id, sftpFailure, "bad handle")
+		}
+		info, err := c.nfs.Stat(h.path)
+		if err != nil {
+			return sftpError(id, err)
+		}
+		return sftpAttrsOf([]byte{sftpAttrs}, id, info)
+	case sftpReaddir:
+		h, ok := c.handles[d.str()]
+		if !ok || h.file != nil {
+			return sftpStatusReply(id, sftpFailure, "bad handle")
+		}
+		if h.read >= len(h.entries) {
+			return sftpStatusReply(id, sftpEOF, "EOF")
+		}
+		end := h.read + sftpReaddirBatch
+		if end > len(h.entries) {
+			end = len(h.entries)
+		}
+		batch := h.entries[h.read:end]
+		h.read = end
+		names := make([]string, len(batch))
+		for i, info := range batch {
+			names[i] = info.Name()
+		}
+		return sftpNames(id, batch, names)
+	case sftpClose:
+		name := d.str()
+		if h, ok := c.handles[name]; ok && h.file != nil {
+			h.file.Close()
+		}
+		delete(c.handles, name)
+		return sftpStatusReply(id, sftpOK, "")
+	case sftpWrite, sftpSetstat, sftpFsetstat, sftpRemove, sftpMkdir, sftpRmdir, sftpRename, sftpSymlink:
+		return sftpStatusReply(id, sftpPermissionDenied, "read only")
+	}
+	return sftpStatusReply(id, sftpOpUnsupported, "not supported")
+}
+
+/* like realpath(3): an absolute path to `p` with no symlinks, "." or ".." in it */
+func (c *sftpConn) realpath(p string) (string, error) {
+	/* everything is relative to the root */
+	parts := splitParts(p)
+	var resolved []string
+	hops := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+		switch part {
+		case ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+		resolved = append(resolved, part)
+		current := strings.Join(resolved, "/")
+		info, err := c.nfs.Lstat(current)
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if hops++; hops > maxSymlinkHops {
+			return "", syscall.ELOOP
+		}
+		target, err := c.nfs.Readlink(current)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			return "", fmt.Errorf("%s points outside the filesystem: %s", current, target)
+		}
+		/* the target is relative to the link's directory */
+		resolved = resolved[:len(resolved)-1]
+		parts = append(splitParts(target), parts...)
+	}
+	return "/" + strings.Join(resolved, "/"), nil
+}
+
+/* for when the client goes away without closing everything */
+func (c *sftpConn) closeAll() {
+	for name, h := range c.handles {
+		if h.file != nil {
+			h.file.Close()
+		}
+		delete(c.handles, name)
+	}
+}
+
+func (c *sftpConn) newHandle(id uint32, h *sftpOpenFile) []byte {
+	c.nextID++
+	name := strconv.Itoa(c.nextID)
+	c.handles[name] = h
+	return sftpstr(sftpu32([]byte{sftpHandle}, id), name)
+}
+
+func sftpStatusReply(id uint32, code uint32, message string) []byte {
+	b := sftpu32(sftpu32([]byte{sftpStatus}, id), code)
+	return sftpstr(sftpstr(b, message), "")
+}
+
+func sftpError(id uint32, err error) []byte {
+	code := uint32(sftpFailure)
+	var errno syscall.Errno
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		code = sftpNoSuchFile
+	case errors.As(toOSError(err), &errno) && errno == syscall.ENOENT:
+		code = sftpNoSuchFile
+	case errors.Is(err, os.ErrPermission):
+		code = sftpPermissionDenied
+	}
+	return sftpStatusReply(id, code, err.Error())
+}
+
+func sftpNames(id uint32, infos []os.FileInfo, names []string) []byte {
+	b := sftpu32(sftpu32([]byte{sftpName}, id), uint32(len(infos)))
+	for i, info := range infos {
+		b = sftpstr(b, names[i])
+		b = sftpstr(b, longName(info, names[i]))
+		b = appendAttrs(b, info)
+	}
+	return b
+}
+
+func sftpAttrsOf(b []byte, id uint32, info os.FileInfo) []byte {
+	return appendAttrs(sftpu32(b, id), info)
+}
+
+func appendAttrs(b []byte, info os.FileInfo) []byte {
+	const flags = 0x1 | 0x2 | 0x4 | 0x8 /* size, uid/gid, permissions, times */
+	b = sftpu32(b, flags)
+	b = sftpu64(b, uint64(info.Size()))
+	b = sftpu32(b, uint32(os.Getuid()))
+	b = sftpu32(b, uint32(os.Getgid()))
+	b = sftpu32(b, unixMode(info))
+	mtime := uint32(info.ModTime().Unix())
+	return sftpu32(sftpu32(b, mtime), mtime)
+}
+
+func unixMode(info os.FileInfo) uint32 {
+	mode := uint32(info.Mode().Perm())
+	switch {
+	case info.IsDir():
+		mode |= syscall.S_IFDIR
+	case info.Mode()&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	default:
+		mode |= syscall.S_IFREG
+	}
+	return mode
+}
+
+/* what `ls -l` would say, some clients show this */
+func longName(info os.FileInfo, name string) string {
+	mode := []byte(info.Mode().String())
+	if info.Mode()&os.ModeSymlink != 0 {
+		mode[0] = 'l'
+	}
+	return fmt.Sprintf("%s 1 git git %8d %s %s", mode, info.Size(), info.ModTime().Format("Jan _2 15:04"), name)
+}
+
+/* encoding & decoding, everything is big endian */
+
+func sftpu32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func sftpu64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func sftpstr(b []byte, s string) []byte {
+	return append(sftpu32(b, uint32(len(s))), s...)
+}
+
+type sftpDecoder struct {
+	b []byte
+	/* set if the packet was too short */
+	err bool
+}
+
+func (d *sftpDecoder) next(n int) []byte {
+	if n < 0 || len(d.b) < n {
+		d.err = true
+		d.b = nil
+		return make([]byte, 8)
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *sftpDecoder) u32() uint32 {
+	return binary.BigEndian.Uint32(d.next(4))
+}
+
+func (d *sftpDecoder) u64() uint64 {
+	return binary.BigEndian.Uint64(d.next(8))
+}
+
+func (d *sftpDecoder) str() string {
+	n := int(d.u32())
+	if n > len(d.b) {
+		d.err = true
+		d.b = nil
+		return ""
+	}
+	return string(d.next(n))
+}
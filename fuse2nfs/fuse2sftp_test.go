@@ -0,0 +1,214 @@
+package fuse2nfs
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+type sftpClient struct {
+	t    *testing.T
+	conn net.Conn
+	id   uint32
+}
+
+func newSFTPClient(t *testing.T) *sftpClient {
+	client, server := net.Pipe()
+	c := &sftpConn{rw: server, nfs: newFuseNFSfs(newFakeFS(), Options{FollowSymlinks: true}), handles: make(map[string]*sftpOpenFile)}
+	go func() {
+		c.serve()
+		server.Close()
+	}()
+	t.Cleanup(func() { client.Close() })
+	s := &sftpClient{t: t, conn: client}
+	if typ, _ := s.send(sftpu32([]byte{sftpInit}, 3)); typ != sftpVersion {
+		t.Fatalf("got a %d instead of SSH_FXP_VERSION", typ)
+	}
+	return s
+}
+
+/* sends a packet and returns the reply's type and what's after it */
+func (s *sftpClient) send(packet []byte) (uint8, *sftpDecoder) {
+	if _, err := s.conn.Write(append(sftpu32(nil, uint32(len(packet))), packet...)); err != nil {
+		s.t.Fatal(err)
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(s.conn, size[:]); err != nil {
+		s.t.Fatal(err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(s.conn, reply); err != nil {
+		s.t.Fatal(err)
+	}
+	return reply[0], &sftpDecoder{b: reply[1:]}
+}
+
+/* a request with the next id, checking that the reply has the same id */
+func (s *sftpClient) request(typ uint8, body []byte) (uint8, *sftpDecoder) {
+	s.id++
+	rtyp, d := s.send(append(sftpu32([]byte{typ}, s.id), body...))
+	if id := d.u32(); id != s.id {
+		s.t.Fatalf("sent id %d, got %d back", s.id, id)
+	}
+	return rtyp, d
+}
+
+/* the status code, or -1 if it's not a status */
+func statusCode(typ uint8, d *sftpDecoder) int {
+	if typ != sftpStatus {
+		return -1
+	}
+	return int(d.u32())
+}
+
+func (s *sftpClient) open(p string, pflags uint32) (string, int) {
+	typ, d := s.request(sftpOpen, sftpu32(sftpu32(sftpstr(nil, p), pflags), 0))
+	if typ == sftpHandle {
+		return d.str(), -1
+	}
+	return "", statusCode(typ, d)
+}
+
+func TestSFTPRead(t *testing.T) {
+	s := newSFTPClient(t)
+	handle, code := s.open("d/b.go", 1)
+	if code != -1 {
+		t.Fatalf("open: %d", code)
+	}
+	typ, d := s.request(sftpRead, sftpu32(sftpu64(sftpstr(nil, handle), 2), 100))
+	if typ != sftpData {
+		t.Fatalf("read: %d", statusCode(typ, d))
+	}
+	if got := d.str(); got != "ckage b\n" {
+		t.Errorf("read %q", got)
+	}
+	typ, d = s.request(sftpRead, sftpu32(sftpu64(sftpstr(nil, handle), 100), 100))
+	if code := statusCode(typ, d); code != sftpEOF {
+		t.Errorf("reading past the end: %d", code)
+	}
+	s.request(sftpClose, sftpstr(nil, handle))
+	typ, d = s.request(sftpRead, sftpu32(sftpu64(sftpstr(nil, handle), 0), 100))
+	if code := statusCode(typ, d); code != sftpFailure {
+		t.Errorf("reading a closed handle: %d", code)
+	}
+}
+
+func TestSFTPOpenFlags(t *testing.T) {
+	s := newSFTPClient(t)
+	tests := []struct {
+		pflags uint32
+		code   int
+	}{
+		{0x01, -1},
+		/* not a flag we know about, but it doesn't write */
+		{0x01 | 0x40, -1},
+		{0x01 | sftpFlagWrite, sftpPermissionDenied},
+		{sftpFlagWrite | sftpFlagCreat | sftpFlagTrunc, sftpPermissionDenied},
+		{0x01 | sftpFlagAppend, sftpPermissionDenied},
+		{0x01 | sftpFlagExcl, sftpPermissionDenied},
+	}
+	for _, test := range tests {
+		if _, code := s.open("README.md", test.pflags); code != test.code {
+			t.Errorf("pflags %#x: got %d, want %d", test.pflags, code, test.code)
+		}
+	}
+	if _, code := s.open("d", 1); code != sftpFailure {
+		t.Errorf("opening a directory: %d", code)
+	}
+	if _, code := s.open("missing", 1); code != sftpNoSuchFile {
+		t.Errorf("opening a missing file: %d", code)
+	}
+}
+
+func TestSFTPRealpath(t *testing.T) {
+	s := newSFTPClient(t)
+	tests := []struct {
+		path, want string
+	}{
+		{"", "/"},
+		{".", "/"},
+		{"/d/../README.md", "/README.md"},
+		{"link", "/d/b.go"},
+		/* up -> .. , so this is d/../d/b.go */
+		{"d/../up/d/./b.go", "/d/b.go"},
+		{"up/up/link", "/d/b.go"},
+	}
+	for _, test := range tests {
+		typ, d := s.request(sftpRealpath, sftpstr(nil, test.path))
+		if typ != sftpName {
+			t.Errorf("%q: %d", test.path, statusCode(typ, d))
+			continue
+		}
+		if n, got := d.u32(), d.str(); n != 1 || got != test.want {
+			t.Errorf("%q: got %q, want %q", test.path, got, test.want)
+		}
+	}
+	typ, d := s.request(sftpRealpath, sftpstr(nil, "d/missing"))
+	if code := statusCode(typ, d); code != sftpNoSuchFile {
+		t.Errorf("missing file: %d", code)
+	}
+}
+
+func TestSFTPOpendir(t *testing.T) {
+	s := newSFTPClient(t)
+	typ, d := s.request(sftpOpendir, sftpstr(nil, "README.md"))
+	if code := statusCode(typ, d); code != sftpFailure {
+		t.Errorf("opendir on a file: %d", code)
+	}
+	typ, d = s.request(sftpOpendir, sftpstr(nil, ""))
+	if typ != sftpHandle {
+		t.Fatalf("opendir: %d", statusCode(typ, d))
+	}
+	handle := d.str()
+	typ, d = s.request(sftpReaddir, sftpstr(nil, handle))
+	if typ != sftpName {
+		t.Fatalf("readdir: %d", statusCode(typ, d))
+	}
+	var names []string
+	for n := d.u32(); n > 0; n-- {
+		names = append(names, d.str())
+		d.str() /* longname */
+		d.next(4 + 8 + 4 + 4 + 4 + 4 + 4)
+	}
+	if len(names) != 5 || names[0] != "README.md" || names[3] != "link" {
+		t.Errorf("got %q", names)
+	}
+	typ, d = s.request(sftpReaddir, sftpstr(nil, handle))
+	if code := statusCode(typ, d); code != sftpEOF {
+		t.Errorf("second readdir: %d", code)
+	}
+}
+
+func TestSFTPBadPackets(t *testing.T) {
+	s := newSFTPClient(t)
+	/* a path that's longer than the packet */
+	typ, d := s.request(sftpOpen, sftpu32(nil, 100))
+	if code := statusCode(typ, d); code != sftpBadMessage {
+		t.Errorf("short open: %d", code)
+	}
+	typ, d = s.request(sftpMkdir, sftpstr(nil, "new"))
+	if code := statusCode(typ, d); code != sftpPermissionDenied {
+		t.Errorf("mkdir: %d", code)
+	}
+	typ, d = s.request(200, nil)
+	if code := statusCode(typ, d); code != sftpOpUnsupported {
+		t.Errorf("unknown packet: %d", code)
+	}
+}
+
+func TestSFTPDecoder(t *testing.T) {
+	b := sftpstr(sftpu64(sftpu32(nil, 1), 2), "hi")
+	d := &sftpDecoder{b: b}
+	if d.u32() != 1 || d.u64() != 2 || d.str() != "hi" || d.err {
+		t.Errorf("didn't decode %v", b)
+	}
+	d = &sftpDecoder{b: sftpu32(nil, 10)}
+	if d.str(); !d.err {
+		t.Errorf("a string longer than the packet should be an error")
+	}
+	d = &sftpDecoder{b: []byte{1, 2}}
+	if d.u32(); !d.err {
+		t.Errorf("a short u32 should be an error")
+	}
+}
@@ -0,0 +1,312 @@
+package fuse2nfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/fnv"
+	"io/fs"
+	"math"
+	"strings"
+	"sync"
+
+	billy "github.com/go-git/go-billy/v5"
+	nfs "github.com/willscott/go-nfs"
+	"github.com/willscott/go-nfs/file"
+)
+
+/*
+  NFS file handles.
+
+  The NFS client remembers a handle for every file it's seen and expects it
+  to keep working forever. go-nfs's CachingHandler hands out random handles
+  and forgets them when its LRU fills up (or when we restart), and then the
+  client gets "Stale file handle" errors.
+
+  Instead, the handle *is* the path, so we never need to remember anything.
+  The problem is that handles can only be 64 bytes and paths like
+  commits/ab/abcd/<hash>/some/file.go are longer than that. So there are 3
+  kinds of handles:
+
+  * 'p': short paths, just the path
+  * 'i': everything in commits/ and objects/ under a directory whose name
+         ends with a commit or tree hash (like commits/ab/abcd/<hash>): the
+         path up to the hash, then the hash as 20 bytes, then the position of
+         each file in its directory listing. Those listings never change
+         because git objects never change. Other folders can have hashes in
+         their names too (like pickaxe/ and workspaces/) but what's in them
+         can change, so they don't get 'i' handles.
+  * 'h': all the other long paths: a hash of the path. These are the only
+         ones we have to remember, so they go stale after a restart, and we
+         only remember the last `maxLongPaths` of them.
+
+  Every handle starts with the file's inode (what Lstat says), which go-nfs
+  uses as the fileid for `.` and `..`, so it has to be the same fileid that
+  GETATTR returns. We check it when decoding so that we never return the
+  wrong file.
+*/
+
+const maxHandleSize = 64
+
+/* about 10MB */
+const maxLongPaths = 50000
+
+type StableHandles struct {
+	nfs.Handler
+	fs billy.Filesystem
+
+	lock sync.Mutex
+	/* for 'h' handles */
+	longPaths map[string][]string
+	/* directory listings under a hash never change, so we can keep them */
+	listings map[string][]string
+	/* for READDIR cookies */
+	verifiers map[uint64][]fs.FileInfo
+}
+
+/* wraps `h` (which handles everything except file handles) */
+func NewStableHandles(h nfs.Handler, filesystem billy.Filesystem) nfs.Handler {
+	return &StableHandles{
+		Handler:   h,
+		fs:        filesystem,
+		longPaths: make(map[string][]string),
+		listings:  make(map[string][]string),
+		verifiers: make(map[uint64][]fs.FileInfo),
+	}
+}
+
+func (s *StableHandles) ToHandle(_ billy.Filesystem, path []string) []byte {
+	joined := strings.Join(path, "/")
+	handle := binary.BigEndian.AppendUint64(nil, s.fileID(joined))
+	if len(joined) <= maxHandleSize-len(handle)-1 {
+		return append(append(handle, 'p'), joined...)
+	}
+	if h := s.indexHandle(handle, path); h != nil {
+		return h
+	}
+	sum := sha256.Sum256([]byte(joined))
+	s.lock.Lock()
+	/* don't use up all the memory */
+	if len(s.longPaths) >= maxLongPaths {
+		s.longPaths = make(map[string][]string)
+	}
+	s.longPaths[string(sum[:])] = path
+	s.lock.Unlock()
+	return append(append(handle, 'h'), sum[:]...)
+}
+
+func (s *StableHandles) FromHandle(fh []byte) (billy.Filesystem, []string, error) {
+	stale := &nfs.NFSStatusError{NFSStatus: nfs.NFSStatusStale}
+	if len(fh) < 9 {
+		return nil, nil, stale
+	}
+	var path []string
+	payload := fh[9:]
+	switch fh[8] {
+	case 'p':
+		if len(payload) > 0 {
+			path = strings.Split(string(payload), "/")
+		}
+	case 'i':
+		var ok bool
+		if path, ok = s.decodeIndexHandle(payload); !ok {
+			return nil, nil, stale
+		}
+	case 'h':
+		s.lock.Lock()
+		p, ok := s.longPaths[string(payload)]
+		s.lock.Unlock()
+		if !ok {
+			return nil, nil, stale
+		}
+		path = p
+	default:
+		return nil, nil, stale
+	}
+	if binary.BigEndian.Uint64(fh[:8]) != s.fileID(strings.Join(path, "/")) {
+		return nil, nil, stale
+	}
+	return s.fs, path, nil
+}
+
+/* the inode Lstat reports for `path`, or a hash of the path if there isn't one */
+func (s *StableHandles) fileID(path string) uint64 {
+	if info, err := s.fs.Lstat(path); err == nil {
+		if attr := file.GetInfo(info); attr != nil {
+			return attr.Fileid
+		}
+	}
+	return pathHash(path)
+}
+
+/* there's no limit, but go-nfs also uses this to decide how big READDIR replies can be */
+func (s *StableHandles) HandleLimit() int {
+	return math.MaxInt32
+}
+
+func pathHash(path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	return h.Sum64()
+}
+
+/* returns nil if the path doesn't have a hash in it or if it's too deep */
+func (s *StableHandles) indexHandle(handle []byte, path []string) []byte {
+	if len(path) == 0 || (path[0] != "commits" && path[0] != "objects") {
+		return nil
+	}
+	anchor := -1
+	for i := len(path) - 1; i >= 0; i-- {
+		if endsWithHash(path[i]) {
+			anchor = i
+			break
+		}
+	}
+	if anchor < 0 {
+		return nil
+	}
+	prefix := strings.Join(path[:anchor], "/")
+	name := path[anchor][:len(path[anchor])-40]
+	if len(prefix) > math.MaxUint8 {
+		return nil
+	}
+	id, _ := hex.DecodeString(path[anchor][len(name):])
+	handle = append(handle, 'i', byte(len(prefix)))
+	handle = append(handle, prefix...)
+	handle = append(handle, byte(len(name)))
+	handle = append(handle, name...)
+	handle = append(handle, id...)
+	for i := anchor + 1; i < len(path); i++ {
+		names, err := s.listing(path[:i])
+		if err != nil {
+			return nil
+		}
+		index := indexOf(names, path[i])
+		if index < 0 {
+			return nil
+		}
+		handle = binary.AppendUvarint(handle, uint64(index))
+		if len(handle) > maxHandleSize {
+			return nil
+		}
+	}
+	/* the prefix and name can make it too long even with nothing after the hash */
+	if len(handle) > maxHandleSize {
+		return nil
+	}
+	return handle
+}
+
+func (s *StableHandles) decodeIndexHandle(payload []byte) ([]string, bool) {
+	if len(payload) < 1 {
+		return nil, false
+	}
+	prefixLen := int(payload[0])
+	if len(payload) < 1+prefixLen+1 {
+		return nil, false
+	}
+	var path []string
+	if prefixLen > 0 {
+		path = strings.Split(string(payload[1:1+prefixLen]), "/")
+	}
+	rest := payload[1+prefixLen:]
+	nameLen := int(rest[0])
+	if len(rest) < 1+nameLen+20 {
+		return nil, false
+	}
+	path = append(path, string(rest[1:1+nameLen])+hex.EncodeToString(rest[1+nameLen:1+nameLen+20]))
+	rest = rest[1+nameLen+20:]
+	for len(rest) > 0 {
+		index, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, false
+		}
+		rest = rest[n:]
+		names, err := s.listing(path)
+		if err != nil || index >= uint64(len(names)) {
+			return nil, false
+		}
+		path = append(path, names[index])
+	}
+	return path, true
+}
+
+/* the names in a directory, in the same order every time */
+func (s *StableHandles) listing(path []string) ([]string, error) {
+	joined := strings.Join(path, "/")
+	s.lock.Lock()
+	names, ok := s.listings[joined]
+	s.lock.Unlock()
+	if ok {
+		return names, nil
+	}
+	var err error
+	if f, ok := s.fs.(*FuseNFSfs); ok {
+		/* much faster than ReadDir because it doesn't need to Attr everything */
+		names, err = f.readDirNames(joined)
+	} else {
+		var infos []fs.FileInfo
+		infos, err = s.fs.ReadDir(joined)
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	/* don't use up all the memory */
+	if len(s.listings) > 10000 {
+		s.listings = make(map[string][]string)
+	}
+	s.listings[joined] = names
+	return names, nil
+}
+
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func endsWithHash(name string) bool {
+	if len(name) < 40 || len(name)-40 > math.MaxUint8 {
+		return false
+	}
+	/* it has to come out the same after decoding, so no uppercase */
+	hash := name[len(name)-40:]
+	id, err := hex.DecodeString(hash)
+	return err == nil && hex.EncodeToString(id) == hash
+}
+
+/*
+go-nfs uses these to make READDIR work when a directory takes more than 1
+reply: it gives the client a verifier and later asks us what the listing was
+*/
+
+func (s *StableHandles) VerifierFor(path string, contents []fs.FileInfo) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	for _, c := range contents {
+		h.Write([]byte{0})
+		h.Write([]byte(c.Name()))
+	}
+	id := h.Sum64()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.verifiers) > 1000 {
+		s.verifiers = make(map[uint64][]fs.FileInfo)
+	}
+	s.verifiers[id] = contents
+	return id
+}
+
+func (s *StableHandles) DataForVerifier(path string, id uint64) []fs.FileInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.verifiers[id]
+}
@@ -0,0 +1,142 @@
+package fuse2nfs
+
+import (
+	"context"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/fuse"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/willscott/go-nfs/file"
+)
+
+const testHash = "c6ef1ee628623f55294d8b3fdc1e661cdde75c99"
+
+func testFS(t *testing.T, files ...string) *StableHandles {
+	fs := memfs.New()
+	for _, f := range files {
+		if err := util.WriteFile(fs, f, []byte("hi"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewStableHandles(nil, fs).(*StableHandles)
+}
+
+func TestHandleRoundTrip(t *testing.T) {
+	tests := []struct {
+		path string
+		kind byte
+	}{
+		{"", 'p'},
+		{"branches/main", 'p'},
+		{"commits/c6/c6ef/" + testHash + "/fuse/commit.go", 'i'},
+		{"commits/c6/c6ef/" + testHash + "/a/b/c/d/e/f/g/h/i/j/k/l.txt", 'i'},
+		{"objects/c6/c6ef/" + testHash + "/README.md", 'i'},
+		/* long enough that the hash is the last part and it's still too long */
+		{"branch_histories/a-long-branch-name/00-" + testHash, 'h'},
+		{"pickaxe/a needle that is quite long/00-" + testHash, 'h'},
+		/* pickaxe results change, so no 'i' even when it would fit */
+		{"pickaxe/x/00-" + testHash + "/README.md", 'h'},
+		{"workspaces/w/" + testHash + "/file", 'h'},
+		{"blame/" + strings.Repeat("x", 100), 'h'},
+	}
+	var files []string
+	for _, test := range tests {
+		if test.path != "" {
+			files = append(files, test.path)
+		}
+	}
+	s := testFS(t, files...)
+	for _, test := range tests {
+		var path []string
+		if test.path != "" {
+			path = strings.Split(test.path, "/")
+		}
+		handle := s.ToHandle(nil, path)
+		if len(handle) > maxHandleSize {
+			t.Errorf("%s: handle is %d bytes", test.path, len(handle))
+		}
+		if handle[8] != test.kind {
+			t.Errorf("%s: got a '%c' handle, want '%c'", test.path, handle[8], test.kind)
+		}
+		_, got, err := s.FromHandle(handle)
+		if err != nil {
+			t.Errorf("%s: %s", test.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, path) {
+			t.Errorf("%s: decoded to %q", test.path, got)
+		}
+	}
+}
+
+/* only 'h' handles need anything from before a restart */
+func TestHandlesAfterRestart(t *testing.T) {
+	long := "commits/c6/c6ef/" + testHash + "/some/file.go"
+	other := "pickaxe/" + strings.Repeat("x", 60)
+	before := testFS(t, long, other)
+	after := testFS(t, long, other)
+
+	_, got, err := after.FromHandle(before.ToHandle(nil, strings.Split(long, "/")))
+	if err != nil || strings.Join(got, "/") != long {
+		t.Errorf("%s: got %q, %v", long, got, err)
+	}
+	if _, _, err := after.FromHandle(before.ToHandle(nil, strings.Split(other, "/"))); err == nil {
+		t.Errorf("%s: expected a stale handle", other)
+	}
+}
+
+func TestBadHandles(t *testing.T) {
+	s := testFS(t, "commits/c6/c6ef/"+testHash+"/file")
+	good := s.ToHandle(nil, strings.Split("commits/c6/c6ef/"+testHash+"/file", "/"))
+	wrongHash := append([]byte{}, good...)
+	binary.BigEndian.PutUint64(wrongHash, 1)
+	badIndex := append(append([]byte{}, good[:len(good)-1]...), 99)
+	for name, handle := range map[string][]byte{
+		"empty":      {},
+		"short":      good[:5],
+		"truncated":  good[:20],
+		"wrong hash": wrongHash,
+		"bad index":  badIndex,
+		"bad kind":   append(append([]byte{}, good[:8]...), 'x'),
+		"unknown h":  append(append([]byte{}, good[:8]...), 'h', 1, 2, 3),
+	} {
+		if _, _, err := s.FromHandle(handle); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+type fakeNumbered uint64
+
+func (f fakeNumbered) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0o444
+	a.Inode = uint64(f)
+	return nil
+}
+
+/* go-nfs uses the start of the handle as the fileid for `.`, so it has to match GETATTR */
+func TestHandleFileID(t *testing.T) {
+	fake := newFakeFS()
+	long := strings.Repeat("x", 70)
+	fake.root["numbered"] = fakeNumbered(1234)
+	fake.root["d"].(fakeDir)[long] = fakeNumbered(5678)
+	fs := newFuseNFSfs(fake, Options{})
+	s := NewStableHandles(nil, fs).(*StableHandles)
+	for _, p := range []string{"numbered", "d/" + long} {
+		handle := s.ToHandle(nil, strings.Split(p, "/"))
+		info, err := fs.Lstat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := binary.BigEndian.Uint64(handle[:8]), file.GetInfo(info).Fileid; got != want {
+			t.Errorf("%s: handle starts with %d, Lstat says %d", p, got, want)
+		}
+		if _, got, err := s.FromHandle(handle); err != nil || strings.Join(got, "/") != p {
+			t.Errorf("%s: decoded to %q, %v", p, got, err)
+		}
+	}
+}
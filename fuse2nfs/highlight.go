@@ -0,0 +1,145 @@
+package fuse2nfs
+
+import (
+	"html"
+	"html/template"
+	"path"
+	"strings"
+)
+
+/*
+  A very small syntax highlighter for the HTTP file browser. It only knows
+  about comments, strings, numbers and keywords, and it doesn't try very hard
+  to be correct, but that's enough to make code a lot easier to read.
+*/
+
+type language struct {
+	lineComments  []string
+	blockComments [][2]string
+	quotes        string
+	keywords      map[string]bool
+}
+
+func words(s string) map[string]bool {
+	m := make(map[string]bool)
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var cLike = [][2]string{{"/*", "*/"}}
+
+var languages = map[string]*language{
+	".go": {[]string{"//"}, cLike, "\"'`", words(`break case chan const continue default defer else fallthrough
+		for func go goto if import interface map package range return select struct switch type var
+		nil true false`)},
+	".py": {[]string{"#"}, nil, "\"'", words(`and as assert async await break class continue def del elif else
+		except finally for from global if import in is lambda nonlocal not or pass raise return try
+		while with yield None True False`)},
+	".js": {[]string{"//"}, cLike, "\"'`", words(`async await break case catch class const continue default delete
+		do else export extends finally for function if import in instanceof let new of return switch
+		this throw try typeof var void while yield null undefined true false`)},
+	".c": {[]string{"//"}, cLike, "\"'", words(`auto break case char const continue default do double else enum
+		extern float for goto if int long register return short signed sizeof static struct switch
+		typedef union unsigned void volatile while class namespace public private protected template
+		new delete true false NULL`)},
+	".rs": {[]string{"//"}, cLike, "\"", words(`as break const continue crate else enum extern false fn for if impl
+		in let loop match mod move mut pub ref return self Self static struct super trait true type
+		unsafe use where while`)},
+	".rb": {[]string{"#"}, nil, "\"'", words(`begin break case class def do else elsif end ensure false for if in
+		module next nil not or and redo rescue retry return self super then true unless until when
+		while yield`)},
+	".sh": {[]string{"#"}, nil, "\"'", words(`if then else elif fi case esac for while until do done in function
+		return local export`)},
+}
+
+func init() {
+	for _, ext := range []string{".ts", ".jsx", ".tsx", ".mjs"} {
+		languages[ext] = languages[".js"]
+	}
+	for _, ext := range []string{".h", ".cc", ".cpp", ".hpp", ".java"} {
+		languages[ext] = languages[".c"]
+	}
+	languages[".bash"] = languages[".sh"]
+}
+
+func span(class, text string) string {
+	return `<span class="` + class + `">` + html.EscapeString(text) + `</span>`
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func highlight(name, src string) template.HTML {
+	lang, ok := languages[path.Ext(name)]
+	if !ok {
+		return template.HTML(html.EscapeString(src))
+	}
+	var out strings.Builder
+	i := 0
+next:
+	for i < len(src) {
+		rest := src[i:]
+		for _, c := range lang.blockComments {
+			if strings.HasPrefix(rest, c[0]) {
+				end := strings.Index(rest[len(c[0]):], c[1])
+				if end < 0 {
+					end = len(rest)
+				} else {
+					end += len(c[0]) + len(c[1])
+				}
+				out.WriteString(span("c", rest[:end]))
+				i += end
+				continue next
+			}
+		}
+		for _, c := range lang.lineComments {
+			if strings.HasPrefix(rest, c) {
+				end := strings.IndexByte(rest, '\n')
+				if end < 0 {
+					end = len(rest)
+				}
+				out.WriteString(span("c", rest[:end]))
+				i += end
+				continue next
+			}
+		}
+		ch := src[i]
+		switch {
+		case strings.IndexByte(lang.quotes, ch) >= 0:
+			end := 1
+			/* only backticks can go past the end of the line */
+			for end < len(rest) && rest[end] != ch && (rest[end] != '\n' || ch == '`') {
+				if rest[end] == '\\' && end+1 < len(rest) {
+					end++
+				}
+				end++
+			}
+			if end < len(rest) && rest[end] == ch {
+				end++
+			}
+			out.WriteString(span("s", rest[:end]))
+			i += end
+		case isWordChar(ch):
+			end := 1
+			for end < len(rest) && isWordChar(rest[end]) {
+				end++
+			}
+			word := rest[:end]
+			if ch >= '0' && ch <= '9' {
+				out.WriteString(span("n", word))
+			} else if lang.keywords[word] {
+				out.WriteString(span("k", word))
+			} else {
+				out.WriteString(html.EscapeString(word))
+			}
+			i += end
+		default:
+			out.WriteString(html.EscapeString(rest[:1]))
+			i++
+		}
+	}
+	return template.HTML(out.String())
+}
@@ -0,0 +1,173 @@
+package fuse2nfs
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/anacrolix/fuse/fs"
+)
+
+/*
+  NFS and WebDAV give us paths, not nodes, so every Stat/Open/ReadDir has to
+  look up every part of the path starting from the root. For something like
+  commits/ab/abcd/<hash>/a/b/c.go that's a lot of tree reading, so we remember
+  which node each path resolved to.
+
+  Everything in commits/ and objects/ never changes, so we can keep those
+  until they fall out of the LRU. Anything else (like branches/main) can
+  change at any time, so those only get cached for a second.
+*/
+
+const nodeCacheSize = 10000
+
+type nodeCache struct {
+	lock    sync.Mutex
+	entries map[string]*list.Element
+	/* most recently used first */
+	order *list.List
+}
+
+type cachedNode struct {
+	path    string
+	node    fs.Node
+	expires time.Time /* zero if it never expires */
+}
+
+func newNodeCache() *nodeCache {
+	return &nodeCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func isImmutablePath(path string) bool {
+	return strings.HasPrefix(path, "commits/") || strings.HasPrefix(path, "objects/")
+}
+
+func (c *nodeCache) get(path string) (fs.Node, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elem, ok := c.entries[path]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedNode)
+	if !entry.expires.IsZero() && entry.expires.Before(time.Now()) {
+		c.order.Remove(elem)
+		delete(c.entries, path)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.node, true
+}
+
+func (c *nodeCache) add(path string, node fs.Node) {
+	entry := &cachedNode{path: path, node: node}
+	if !isImmutablePath(path) {
+		entry.expires = time.Now().Add(time.Second)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if elem, ok := c.entries[path]; ok {
+		c.order.Remove(elem)
+	}
+	c.entries[path] = c.order.PushFront(entry)
+	for c.order.Len() > nodeCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedNode).path)
+	}
+}
+
+/* forget `path` and everything inside it, for when we change something */
+func (c *nodeCache) forget(path string) {
+	path = strings.Trim(path, "/")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for p, elem := range c.entries {
+		if p == path || strings.HasPrefix(p, path+"/") {
+			c.order.Remove(elem)
+			delete(c.entries, p)
+		}
+	}
+}
+
+/* Linux gives up after 40 too */
+const maxSymlinkHops = 40
+
+/*
+resolves `filename`, starting from the longest part of it we already know.
+
+With `follow`, symlinks in the middle of the path get followed (and the
+last part too if `followLast`), for clients that don't do that themselves.
+The cache always has the symlink itself, not what it points to, because
+Lstat and Readlink need the symlink.
+*/
+func (c *nodeCache) findNode(ctx context.Context, root fs.FS, filename string, follow, followLast bool) (fs.Node, error) {
+	return c.resolve(ctx, root, splitParts(filename), follow, followLast, 0)
+}
+
+func splitParts(filename string) []string {
+	return strings.FieldsFunc(filename, func(r rune) bool { return r == '/' })
+}
+
+func (c *nodeCache) resolve(ctx context.Context, root fs.FS, parts []string, follow, followLast bool, hops int) (fs.Node, error) {
+	node, err := root.Root()
+	if err != nil {
+		return nil, err
+	}
+	start := 0
+	for i := len(parts); i > 0; i-- {
+		if n, ok := c.get(strings.Join(parts[:i], "/")); ok {
+			node, start = n, i
+			break
+		}
+	}
+	for i := start; i < len(parts); i++ {
+		if follow {
+			node, err = c.followLink(ctx, root, parts[:i], node, hops)
+			if err != nil {
+				return nil, err
+			}
+		}
+		node, err = lookup(ctx, node, parts[:i], parts[i])
+		if err != nil {
+			return nil, err
+		}
+		c.add(strings.Join(parts[:i+1], "/"), node)
+	}
+	if followLast {
+		return c.followLink(ctx, root, parts, node, hops)
+	}
+	return node, nil
+}
+
+/* if `node` (which is at `parts`) is a symlink, returns what it points to */
+func (c *nodeCache) followLink(ctx context.Context, root fs.FS, parts []string, node fs.Node, hops int) (fs.Node, error) {
+	link, ok := node.(fs.NodeReadlinker)
+	if !ok {
+		return node, nil
+	}
+	if hops >= maxSymlinkHops {
+		return nil, syscall.ELOOP
+	}
+	target, err := link.Readlink(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	/* targets are relative to the directory the link is in */
+	dir := strings.Join(parts[:len(parts)-1], "/")
+	resolved := path.Join(dir, target)
+	/* we have no idea what's outside the mount */
+	if strings.HasPrefix(target, "/") || resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return nil, fmt.Errorf("%s points outside the filesystem: %s", strings.Join(parts, "/"), target)
+	}
+	if resolved == "." {
+		/* the root */
+		resolved = ""
+	}
+	return c.resolve(ctx, root, splitParts(resolved), true, true, hops+1)
+}
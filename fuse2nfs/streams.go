@@ -0,0 +1,171 @@
+package fuse2nfs
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/fuse"
+	"github.com/anacrolix/fuse/fs"
+)
+
+/*
+  Some files (like archives/) have their own Open and are made while you read
+  them, so we read them the way FUSE would: open a handle and Read from it,
+  instead of ReadAll-ing the whole thing for every read.
+
+  NFS opens the file again for every READ, and an archive handle has to start
+  over from the beginning if it's a new one. So FuseNFSfs keeps the handles
+  it opens for a little while (by path), and the next READ carries on from
+  where the last one stopped.
+*/
+
+/*
+files that don't know how big they are until they've been read (like
+archives/) can implement this. FUSE just reads them until the end, but NFS,
+9P and SFTP clients believe the size, so we ask when someone stats the file.
+It's not used for directory listings, because it can be slow.
+*/
+type NodeSizer interface {
+	Size(ctx context.Context) (uint64, error)
+}
+
+type nodeStream struct {
+	handle fs.Handle
+	reader fs.HandleReader
+	/* the node's mtime when we opened it, so we know if it changed (like archives/main.tar) */
+	mtime time.Time
+	/* how many FuseFiles are using it, and when the last one stopped */
+	users int
+	used  time.Time
+}
+
+/* opens `node` if it has its own Open and we can Read from it, or returns nil */
+func openStream(ctx context.Context, node fs.Node) (*nodeStream, error) {
+	opener, ok := node.(fs.NodeOpener)
+	if !ok {
+		return nil, nil
+	}
+	handle, err := opener.Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		return nil, err
+	}
+	reader, ok := handle.(fs.HandleReader)
+	if !ok {
+		releaseHandle(ctx, handle)
+		return nil, nil
+	}
+	return &nodeStream{handle: handle, reader: reader}, nil
+}
+
+func releaseHandle(ctx context.Context, handle fs.Handle) {
+	if r, ok := handle.(fs.HandleReleaser); ok {
+		r.Release(ctx, &fuse.ReleaseRequest{})
+	}
+}
+
+func (s *nodeStream) release() {
+	releaseHandle(context.Background(), s.handle)
+}
+
+/* like io.ReaderAt, FUSE reads can be short */
+func (s *nodeStream) readAt(p []byte, off int64) (int, error) {
+	ctx := context.Background()
+	n := 0
+	for n < len(p) {
+		resp := &fuse.ReadResponse{}
+		if err := s.reader.Read(ctx, &fuse.ReadRequest{Offset: off + int64(n), Size: len(p) - n}, resp); err != nil {
+			return n, err
+		}
+		if len(resp.Data) == 0 {
+			return n, io.EOF
+		}
+		n += copy(p[n:], resp.Data)
+	}
+	return n, nil
+}
+
+/* how many idle handles we keep, and for how long */
+const (
+	maxIdleStreams    = 16
+	idleStreamTimeout = time.Minute
+)
+
+type streamCache struct {
+	lock    sync.Mutex
+	streams map[string]*nodeStream
+}
+
+func newStreamCache() *streamCache {
+	return &streamCache{streams: make(map[string]*nodeStream)}
+}
+
+/* the open handle for `node` (which is at `path`), or nil if it doesn't have one */
+func (c *streamCache) get(ctx context.Context, path string, node fs.Node) (*nodeStream, error) {
+	var a fuse.Attr
+	if err := node.Attr(ctx, &a); err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.expire()
+	if s, ok := c.streams[path]; ok {
+		if s.mtime.Equal(a.Mtime) {
+			s.users++
+			return s, nil
+		}
+		/* it's something else now, whoever's still reading the old one can finish */
+		delete(c.streams, path)
+		if s.users == 0 {
+			s.release()
+		}
+	}
+	s, err := openStream(ctx, node)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	s.mtime = a.Mtime
+	s.users = 1
+	c.streams[path] = s
+	return s, nil
+}
+
+/* when a FuseFile is done with `s` */
+func (c *streamCache) put(path string, s *nodeStream) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s.users--
+	s.used = time.Now()
+	if c.streams[path] != s && s.users == 0 {
+		/* it got replaced while we were using it */
+		s.release()
+	}
+}
+
+/* closes the handles nobody's used for a while, and the oldest if there are too many */
+func (c *streamCache) expire() {
+	idle := 0
+	for path, s := range c.streams {
+		if s.users > 0 {
+			continue
+		}
+		if time.Since(s.used) > idleStreamTimeout {
+			delete(c.streams, path)
+			s.release()
+		} else {
+			idle++
+		}
+	}
+	for idle > maxIdleStreams {
+		var oldest string
+		for path, s := range c.streams {
+			if s.users == 0 && (oldest == "" || s.used.Before(c.streams[oldest].used)) {
+				oldest = path
+			}
+		}
+		c.streams[oldest].release()
+		delete(c.streams, oldest)
+		idle--
+	}
+}
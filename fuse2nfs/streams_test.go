@@ -0,0 +1,131 @@
+package fuse2nfs
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const streamContent = "not really a tar\n"
+
+func fakeStreamOf(fs fakeFS) fakeStream {
+	return fs.root["archive.tar"].(fakeStream)
+}
+
+func TestStreamSize(t *testing.T) {
+	nfs := newFuseNFSfs(newFakeFS(), Options{})
+	info, err := nfs.Stat("archive.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != int64(len(streamContent)) {
+		t.Errorf("Stat: size %d", info.Size())
+	}
+	/* listing a directory doesn't make every archive */
+	infos, err := nfs.ReadDir("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		if info.Name() == "archive.tar" && info.Size() != 0 {
+			t.Errorf("ReadDir: size %d", info.Size())
+		}
+	}
+}
+
+/* NFS opens the file for every READ, they should all share one handle */
+func TestStreamReuse(t *testing.T) {
+	fs := newFakeFS()
+	stream := fakeStreamOf(fs)
+	nfs := newFuseNFSfs(fs, Options{})
+	var got []byte
+	for off := 0; off < len(streamContent); off += 5 {
+		file, err := nfs.Open("archive.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		n, err := file.ReadAt(buf, int64(off))
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		got = append(got, buf[:n]...)
+		file.Close()
+	}
+	if string(got) != streamContent {
+		t.Errorf("read %q", got)
+	}
+	if *stream.opened != 1 {
+		t.Errorf("opened it %d times", *stream.opened)
+	}
+	/* it stays open (but unused) for the next READ */
+	if s := nfs.streams.streams["archive.tar"]; s == nil || s.users != 0 {
+		t.Errorf("cached stream: %+v", s)
+	}
+}
+
+func TestStreamRead(t *testing.T) {
+	fs := newFakeFS()
+	stream := fakeStreamOf(fs)
+	file := &FuseFile{node: stream, name: "archive.tar"}
+	got, err := io.ReadAll(file)
+	if err != nil || string(got) != streamContent {
+		t.Errorf("read %q, %v", got, err)
+	}
+	if end, err := file.Seek(-4, io.SeekEnd); err != nil || end != int64(len(streamContent)-4) {
+		t.Errorf("Seek: %d, %v", end, err)
+	}
+	buf := make([]byte, 10)
+	if n, _ := file.Read(buf); string(buf[:n]) != "tar\n" {
+		t.Errorf("read %q after seeking", buf[:n])
+	}
+	file.Close()
+	if *stream.open != 0 {
+		t.Errorf("%d handles still open", *stream.open)
+	}
+}
+
+func TestStreamHTTP(t *testing.T) {
+	fs := newFakeFS()
+	stream := fakeStreamOf(fs)
+	server := httptest.NewServer(Fuse2HTTP(fs))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/archive.tar?raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, []byte(streamContent)) {
+		t.Errorf("got %q", body)
+	}
+	if resp.ContentLength != int64(len(streamContent)) {
+		t.Errorf("Content-Length: %d", resp.ContentLength)
+	}
+	if *stream.open != 0 {
+		t.Errorf("%d handles still open", *stream.open)
+	}
+}
+
+func TestStreamClunk(t *testing.T) {
+	p := new9PClient(t, false)
+	if err := p.walk(1, 2, "archive.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.call(p9Tlopen, p9u32(p9u32(nil, 2), 0)); err != nil {
+		t.Fatal(err)
+	}
+	typ, body := p.rpc(p9Tread, p9u32(p9u64(p9u32(nil, 2), 0), 100))
+	d := &p9Decoder{b: body}
+	if got := string(d.next(int(d.u32()))); typ == p9Rlerror || got != streamContent {
+		t.Errorf("Tread: %q", got)
+	}
+	if err := p.call(p9Tclunk, p9u32(nil, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.server.nfs.streams.streams["archive.tar"]; s == nil || s.users != 0 {
+		t.Errorf("after Tclunk: %+v", s)
+	}
+}
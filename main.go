@@ -1,16 +1,16 @@
 package main
 
 import (
-	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
 
 	"github.com/anacrolix/fuse"
 	"github.com/anacrolix/fuse/fs"
@@ -22,69 +22,144 @@ import (
 	"golang.org/x/net/webdav"
 )
 
-func usage() {
-	fmt.Fprintf(os.Stderr, "Usage:")
-	fmt.Fprintf(os.Stderr, "  %s [options]\n", os.Args[0])
-	fmt.Fprintln(os.Stderr, "Options:")
-	flag.PrintDefaults()
+type options struct {
+	typ          string
+	mountpoint   string
+	repoDir      string
+	writableRefs bool
+	forceTags    bool
+	workspaces   bool
+	hardlinks    bool
+	follow       bool
+	addr         string
+	daemon       bool
+	hostKey      string
+	authKeys     string
 }
 
-type options struct {
-	typ        string
-	mountpoint string
-	repoDir    string
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
 
-func parseOptions() options {
-	var opts options
-	flag.StringVar(&opts.typ, "type", "fuse", "type of mount (webdav, nfs, or fuse)")
-	flag.StringVar(&opts.mountpoint, "mountpoint", "", "mountpoint")
-	flag.StringVar(&opts.repoDir, "repo", ".", "repo dir")
-	flag.Parse()
-	if opts.mountpoint == "" {
-		usage()
-		log.Fatalf("Must specify mountpoint\n")
-	}
-	if opts.typ != "webdav" && opts.typ != "nfs" && opts.typ != "fuse" {
-		usage()
-		log.Fatalf("Invalid type %s\n", opts.typ)
-	}
-	return opts
+/* the -type for `mount`, they return when it's unmounted */
+var mountTypes = map[string]func(*myfuse.FS, options) error{
+	"fuse": func(fs *myfuse.FS, opts options) error {
+		return serveFuse(fs, opts.mountpoint)
+	},
+	"nfs": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serveNFS(fs, opts.mountpoint, opts.follow)
+	},
+	"webdav": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serveDav(fs, opts.mountpoint)
+	},
+	"9p": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serve9P(fs, opts.mountpoint, opts.writableRefs)
+	},
 }
 
-func main() {
-	opts := parseOptions()
+/* the -type for `serve` */
+var serveTypes = map[string]func(*myfuse.FS, options) error{
+	"http": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serveHTTP(fuse2nfs.Fuse2HTTP(fs), opts.addr)
+	},
+	"http-api": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serveHTTP(fuse2nfs.Fuse2API(fs), opts.addr)
+	},
+	"sftp": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serveSFTP(fs, opts.addr, opts.hostKey, opts.authKeys)
+	},
+	/* for mounting it from somewhere else, like a VM */
+	"9p": func(fs *myfuse.FS, opts options) error {
+		defer watchRefs(fs, nil).Close()
+		return serve9PRemote(fs, opts.addr)
+	},
+}
+
+func openFS(opts options) (*myfuse.FS, error) {
 	repo, err := git.PlainOpen(opts.repoDir)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("%s: %w", opts.repoDir, err)
 	}
-	fs := myfuse.New(repo)
+	return myfuse.New(repo, myfuse.Options{
+		WritableRefs:  opts.writableRefs,
+		ForceTags:     opts.forceTags,
+		Workspaces:    opts.workspaces,
+		HardlinkBlobs: opts.hardlinks,
+	}), nil
+}
 
-	createMountpoint(opts.mountpoint)
+func runMount(opts options) int {
+	/* check the repo before going into the background */
+	if _, err := git.PlainOpen(opts.repoDir); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", opts.repoDir, err)
+		return exitError
+	}
+	mountpoint, err := createMountpoint(opts.mountpoint)
 	if err != nil {
-		log.Fatal(err)
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	opts.mountpoint = mountpoint
+	if opts.daemon && os.Getenv(roleEnv) == "" {
+		return startDaemon(opts.mountpoint)
+	} else if opts.daemon && os.Getenv(roleEnv) == "supervisor" {
+		return supervise(opts.mountpoint)
 	}
-	if opts.typ == "webdav" {
-		serveDav(fs, opts.mountpoint)
-	} else if opts.typ == "nfs" {
-		serveNFS(fs, opts.mountpoint)
-	} else {
-		serveFuse(fs, opts.mountpoint)
+	fs, err := openFS(opts)
+	if err == nil {
+		err = mountTypes[opts.typ](fs, opts)
+	}
+	if err != nil {
+		/* the daemon is waiting to hear if it worked */
+		notifyReady(err)
+		log.Print(err)
+		return exitError
 	}
+	return exitOK
 }
 
-func startListener() (net.Listener, int) {
+func runServe(opts options) int {
+	fs, err := openFS(opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := serveTypes[opts.typ](fs, opts); err != nil {
+		log.Print(err)
+		return exitError
+	}
+	return exitOK
+}
+
+/* so that branches/ & tags/ update when the repo changes */
+func watchRefs(fs *myfuse.FS, inv myfuse.Invalidator) io.Closer {
+	watcher, err := fs.WatchRefs(inv)
+	if err != nil {
+		log.Printf("not watching refs for changes: %s", err)
+		return io.NopCloser(nil)
+	}
+	return watcher
+}
+
+func startListener() (net.Listener, int, error) {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
-		log.Fatal(err)
+		return nil, 0, err
 	}
 	log.Println("Server running at", listener.Addr())
 	port := listener.Addr().(*net.TCPAddr).Port
-	return listener, port
+	return listener, port, nil
 }
 
-func serveDav(fs fs.FS, mountpoint string) {
-	davFS := fuse2nfs.Fuse2Dav(fs)
+func serveDav(fs fs.FS, mountpoint string) error {
+	/* WebDAV has no symlinks, so we have to follow them for the client */
+	davFS := fuse2nfs.Fuse2Dav(fs, fuse2nfs.Options{FollowSymlinks: true})
 	srv := &webdav.Handler{
 		FileSystem: davFS,
 		LockSystem: webdav.NewMemLS(),
@@ -92,30 +167,84 @@ func serveDav(fs fs.FS, mountpoint string) {
 	}
 	http.Handle("/", srv)
 
-	listener, port := startListener()
+	listener, port, err := startListener()
+	if err != nil {
+		return err
+	}
 	server := func() error {
 		return http.Serve(listener, nil)
 	}
 	mountCmd := exec.Command("mount", "-t", "webdav", fmt.Sprintf("localhost:%d", port), mountpoint)
-	serve(server, mountCmd, mountpoint)
+	return serve(server, mountCmd, mountpoint)
+}
+
+/* no mounting, just a website */
+func serveHTTP(handler http.Handler, addr string) error {
+	http.Handle("/", handler)
+	log.Printf("Listening on http://%s/\n", addr)
+	return http.ListenAndServe(addr, nil)
 }
 
-func serveNFS(fs fs.FS, mountpoint string) {
-	nfsFS := fuse2nfs.Fuse2NFS(fs)
+func serveNFS(fs fs.FS, mountpoint string, follow bool) error {
+	nfsFS := fuse2nfs.Fuse2NFS(fs, fuse2nfs.Options{FollowSymlinks: follow})
 	handler := nfshelper.NewNullAuthHandler(nfsFS)
-	// was running into problems with stale file handles when this was set to
-	// 1000 so I set this to a bigger number. I don't think that's the right
-	// way to fix the problem but I don't know what is
-	cacheHelper := nfshelper.NewCachingHandler(handler, 10000)
-	listener, port := startListener()
+	/*
+	  file handles are made from the path so that they don't go stale, see
+	  fuse2nfs/handles.go
+	*/
+	handles := fuse2nfs.NewStableHandles(handler, nfsFS)
+	listener, port, err := startListener()
+	if err != nil {
+		return err
+	}
 	server := func() error {
-		return nfs.Serve(listener, cacheHelper)
+		return nfs.Serve(listener, handles)
 	}
 	mountCmd := exec.Command("mount", "-o", fmt.Sprintf("port=%d,mountport=%d", port, port), "-t", "nfs", "localhost:/", mountpoint)
-	serve(server, mountCmd, mountpoint)
+	return serve(server, mountCmd, mountpoint)
+}
+
+func serve9P(fs fs.FS, mountpoint string, writable bool) error {
+	listener, port, err := startListener()
+	if err != nil {
+		return err
+	}
+	server := func() error {
+		return fuse2nfs.Fuse29P(fs, writable).Serve(listener)
+	}
+	mountCmd := exec.Command("mount", "-t", "9p", "-o", fmt.Sprintf("trans=tcp,port=%d,version=9p2000.L", port), "127.0.0.1", mountpoint)
+	return serve(server, mountCmd, mountpoint)
 }
 
-func serveFuse(fuseFS fs.FS, mountpoint string) {
+/* for mounting it from somewhere else, like a VM */
+func serve9PRemote(fs fs.FS, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Server running at", listener.Addr())
+	return fuse2nfs.Fuse29P(fs, false).Serve(listener)
+}
+
+/* no mounting either, use sftp or sshfs */
+func serveSFTP(fs fs.FS, addr, hostKeyFile, authKeysFile string) error {
+	hostKey, err := fuse2nfs.LoadHostKey(hostKeyFile)
+	if err != nil {
+		return err
+	}
+	authKeys, err := fuse2nfs.LoadAuthorizedKeys(authKeysFile)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Println("Server running at", listener.Addr())
+	return fuse2nfs.Fuse2SFTP(fs, hostKey, authKeys).Serve(listener)
+}
+
+func serveFuse(fuseFS *myfuse.FS, mountpoint string) error {
 	c, err := fuse.Mount(
 		mountpoint,
 		fuse.FSName("helloworld"),
@@ -124,56 +253,71 @@ func serveFuse(fuseFS fs.FS, mountpoint string) {
 		fuse.VolumeName("Hello world!"),
 	)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer c.Close()
 
 	<-c.Ready
 
+	srv := fs.New(c, nil)
+	defer watchRefs(fuseFS, srv).Close()
 	server := func() error {
 		defer c.Close()
-		return fs.Serve(c, fuseFS)
+		return srv.Serve(fuseFS)
 	}
-	serve(server, nil, mountpoint)
+	return serve(server, nil, mountpoint)
 }
 
-func serve(server func() error, mountCmd *exec.Cmd, mountpoint string) {
-	serverDone := make(chan error)
+/* mounts it and serves until it's unmounted, or until we get a signal */
+func serve(server func() error, mountCmd *exec.Cmd, mountpoint string) error {
+	serverDone := make(chan error, 1)
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT)
-	signal.Notify(sigchan, syscall.SIGTERM)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
 		serverDone <- server()
 		close(serverDone)
 	}()
-	time.Sleep(500 * time.Millisecond)
+	/* the listener is already listening, so the mount can connect right away */
 	if mountCmd != nil {
-		if err := mountCmd.Run(); err != nil {
-			log.Fatal(err)
+		if out, err := mountCmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
 		}
-		log.Printf("Mounted %s\n", mountpoint)
 	}
+	if err := waitForMount(mountpoint, serverDone); err != nil {
+		unmount(mountpoint)
+		return err
+	}
+	log.Printf("Mounted %s\n", mountpoint)
+	if err := writeState(mountpoint); err != nil {
+		log.Printf("can't write the state file, `list` won't see this mount: %s", err)
+	}
+	defer removeState(mountpoint)
+	notifyReady(nil)
 
+	var serverErr error
 	select {
 	case <-sigchan:
 		fmt.Println("Shutting down...")
-	case err := <-serverDone:
-		if err != nil {
-			log.Fatal(err)
-		}
+	case serverErr = <-serverDone:
 	}
-	umountCmd := exec.Command("umount", mountpoint)
-	if err := umountCmd.Run(); err != nil {
-		fmt.Printf("Error unmounting %s: %v\n", mountpoint, err)
+	/* the server can stop because someone already unmounted it */
+	if isMounted(mountpoint) {
+		if err := unmount(mountpoint); err != nil {
+			fmt.Println(err)
+		}
 	}
+	return serverErr
 }
 
+/* makes the mountpoint if it's not there, and returns its real path (see absPath) */
 func createMountpoint(mountpoint string) (string, error) {
 	if _, err := os.Stat(mountpoint); os.IsNotExist(err) {
-		os.Mkdir(mountpoint, 0755)
+		if err := os.Mkdir(mountpoint, 0755); err != nil {
+			return "", err
+		}
 	}
-	return mountpoint, nil
+	return absPath(mountpoint), nil
 }
 
 func panicOnErr(err error, desc ...interface{}) {